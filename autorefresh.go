@@ -0,0 +1,86 @@
+package myq
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// autoRefreshMargin is how long before the token expires that
+	// StartAutoRefresh renews it
+	autoRefreshMargin = 5 * time.Minute
+
+	// autoRefreshInterval is how often StartAutoRefresh renews a
+	// token whose expiry isn't known
+	autoRefreshInterval = 30 * time.Minute
+
+	// autoRefreshRetry is how long StartAutoRefresh waits to try
+	// again after failing to renew the token
+	autoRefreshRetry = time.Minute
+)
+
+// StartAutoRefresh starts renewing the Session's token in the
+// background shortly before it expires, so that a long-lived Session
+// doesn't have requests rejected when it does.  The token is renewed
+// the same way as by Refresh, but the cached accounts are left alone.
+// Renewal continues until ctx is done or stop is called; stop waits
+// for the background goroutine to exit.
+//
+// Despite the Session otherwise not being safe for concurrent use, it
+// may be used while auto-refresh is running.
+func (s *Session) StartAutoRefresh(ctx context.Context) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTimer(s.nextRefresh())
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			s.mu.Lock()
+			token := s.token
+			s.mu.Unlock()
+
+			next := autoRefreshRetry
+			if err := s.renewToken(ctx, token); err != nil {
+				s.logf("myq: renewing token failed, retrying in %v: %v", next, err)
+			} else {
+				next = s.nextRefresh()
+			}
+			t.Reset(next)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// nextRefresh returns how long to wait before renewing the token
+func (s *Session) nextRefresh() time.Duration {
+	expiry := s.TokenExpiry()
+	if expiry.IsZero() {
+		return autoRefreshInterval
+	}
+
+	// Short-lived tokens are renewed halfway through their
+	// remaining life instead
+	remaining := time.Until(expiry)
+	d := remaining - autoRefreshMargin
+	if d < remaining/2 {
+		d = remaining / 2
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
@@ -0,0 +1,46 @@
+package myq
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// stop must not wait out LoginTimeout when renewing the token falls
+// back to a login that hangs
+func TestStartAutoRefreshStopDuringLogin(t *testing.T) {
+	started := make(chan struct{}, 1)
+	s, srv := testSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	s.Username = "user@example.com"
+	s.Password = "hunter2"
+	s.tokenExpiry = time.Now()
+
+	stop := s.StartAutoRefresh(context.Background())
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("login not started")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop blocked on the login")
+	}
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joeshaw/myq"
@@ -21,23 +30,72 @@ func usage() {
 	})
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "COMMANDS\n")
-	fmt.Fprintf(os.Stderr, "  devices           Print MyQ devices\n")
+	fmt.Fprintf(os.Stderr, "  devices           Print MyQ door openers (all devices with -all)\n")
 	fmt.Fprintf(os.Stderr, "  state             Print current door state for a device\n")
 	fmt.Fprintf(os.Stderr, "  open              Open device\n")
 	fmt.Fprintf(os.Stderr, "  close             Close device\n")
+	fmt.Fprintf(os.Stderr, "  stop              Stop device while opening or closing\n")
+	fmt.Fprintf(os.Stderr, "  on                Turn lamp on\n")
+	fmt.Fprintf(os.Stderr, "  off               Turn lamp off\n")
+	fmt.Fprintf(os.Stderr, "  monitor           Report doors as they open\n")
+	fmt.Fprintf(os.Stderr, "  watch             Report each change in a device's door state\n")
+	fmt.Fprintf(os.Stderr, "  version           Print version and MyQ client information\n")
 	fmt.Fprintf(os.Stderr, "\n")
 }
 
+var (
+	details     bool
+	allDevices  bool
+	check       bool
+	deviceName  string
+	confirm     bool
+	assumeYes   bool
+	jsonOutput  bool
+	showVersion bool
+
+	monitorInterval time.Duration
+	openThreshold   time.Duration
+	closeAllOnExit  bool
+	monitorJitter   time.Duration
+
+	transcriptFile string
+	tokenFile      string
+	logout         bool
+)
+
 func main() {
-	s := &myq.Session{}
+	// Doors shared between accounts are moved through the first, so
+	// only list them that way
+	s := &myq.Session{DeduplicateDevices: true}
 
 	flag.StringVar(&s.Username, "username", "", "MyQ username")
 	flag.StringVar(&s.Password, "password", "", "MyQ password")
+	flag.StringVar(&s.Brand, "brand", "liftmaster", "brand of MyQ devices: liftmaster, chamberlain, or craftsman (all currently log in the same way)")
 	flag.BoolVar(&myq.Debug, "debug", false, "debug mode")
+	flag.BoolVar(&logout, "logout", false, "revoke the MyQ token after running the command, and remove any -token-file")
+	flag.StringVar(&tokenFile, "token-file", "", "reuse the MyQ token saved in this file, and save it there")
+	flag.StringVar(&transcriptFile, "transcript", "", "record a redacted transcript of requests to MyQ to this file")
+	flag.BoolVar(&details, "details", false, "print device details with state")
+	flag.BoolVar(&allDevices, "all", false, "list all devices, not just door openers")
+	flag.StringVar(&deviceName, "name", "", "in state, open, close, stop, on, off, and watch commands, the name of the device")
+	flag.BoolVar(&check, "check", false, "in state command, print a monitoring status line and exit 0 if closed, 1 if open, 2 otherwise")
+	flag.BoolVar(&confirm, "confirm", false, "in open and close commands, ask before moving the door")
+	flag.BoolVar(&assumeYes, "yes", false, "with -confirm, don't ask")
+	flag.BoolVar(&jsonOutput, "json", false, "in devices and state commands, print JSON")
+	flag.BoolVar(&showVersion, "version", false, "print version information")
+	flag.DurationVar(&s.Timeout, "timeout", 30*time.Second, "time limit for each request to MyQ")
+	flag.DurationVar(&monitorInterval, "interval", time.Minute, "polling interval for monitor and watch commands")
+	flag.DurationVar(&openThreshold, "open-threshold", 0, "in monitor command, also report doors open longer than this")
+	flag.DurationVar(&monitorJitter, "jitter", 0, "in monitor and watch commands, delay each poll by up to this much more, at random")
+	flag.BoolVar(&closeAllOnExit, "close-all-on-exit", false, "in monitor command, close doors last seen open when interrupted")
 	flag.Usage = usage
 	flag.Parse()
 
 	args := flag.Args()
+	if showVersion || (len(args) > 0 && strings.ToLower(args[0]) == "version") {
+		printVersion()
+		return
+	}
 	if len(args) < 1 {
 		usage()
 		os.Exit(1)
@@ -52,16 +110,14 @@ func main() {
 	}
 
 	if s.Username == "" {
-		fmt.Fprintf(os.Stderr, "ERROR: -username must be provided\n")
-		os.Exit(1)
+		fatal(errors.New("-username must be provided"))
 	}
 
 	if s.Password == "" {
-		fmt.Fprintf(os.Stderr, "ERROR: -password must be provided\n")
-		os.Exit(1)
+		fatal(errors.New("-password must be provided"))
 	}
 
-	var run func(*myq.Session, []string) error
+	var run func(context.Context, *myq.Session, []string) error
 
 	cmd, args := strings.ToLower(args[0]), args[1:]
 	switch cmd {
@@ -77,32 +133,229 @@ func main() {
 	case "close":
 		run = runClose
 
+	case "stop":
+		run = runStop
+
+	case "on":
+		run = runLampOn
+
+	case "off":
+		run = runLampOff
+
+	case "monitor":
+		run = runMonitor
+
+	case "watch":
+		run = runWatch
+
 	default:
 		usage()
 		os.Exit(1)
 	}
 
-	fmt.Println("Logging into MyQ...")
+	if transcriptFile != "" {
+		f, err := os.Create(transcriptFile)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		myq.Recorder = myq.NewTranscript(f)
+	}
 
-	if err := s.Login(); err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-		os.Exit(1)
+	// Monitoring systems expect a single line of output, and JSON
+	// consumers nothing but JSON
+	quiet := check || jsonOutput
+	if !quiet {
+		s.OnLoginStep = func(step string) {
+			fmt.Printf("  %s\n", step)
+		}
 	}
 
-	if err := run(s, args); err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-		os.Exit(1)
+	var loaded bool
+	if tokenFile != "" {
+		var err error
+		if loaded, err = loadToken(s); err != nil {
+			fatal(err)
+		}
+	}
+
+	if !s.TokenValid() {
+		if !quiet {
+			fmt.Println("Logging into MyQ...")
+		}
+
+		// Renew a saved token, which falls back to logging in
+		login := s.Login
+		if loaded {
+			login = func() error { return s.Refresh(context.Background()) }
+		}
+		if err := login(); err != nil {
+			fatal(err)
+		}
+	}
+
+	if tokenFile != "" {
+		if err := saveToken(s); err != nil {
+			fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		// A second signal terminates immediately
+		signal.Stop(sigs)
+		cancel()
+	}()
+
+	err := run(ctx, s, args)
+
+	switch {
+	case logout:
+		if err := s.Logout(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: logging out: %v\n", err)
+		}
+		if tokenFile != "" {
+			if err := os.Remove(tokenFile); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "ERROR: removing token: %v\n", err)
+			}
+		}
+
+	case tokenFile != "":
+		// The token may have been renewed while running
+		if err := saveToken(s); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: saving token: %v\n", err)
+		}
+	}
+
+	var status exitStatus
+	if errors.As(err, &status) {
+		os.Exit(int(status))
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// exitStatus is returned by a command that has already reported its
+// result, to exit with the status once the token has been revoked or
+// saved
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// loadToken loads the token saved in tokenFile, reporting whether
+// there was one
+func loadToken(s *myq.Session) (bool, error) {
+	f, err := os.Open(tokenFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if err := s.LoadToken(f); err != nil {
+		return false, fmt.Errorf("loading token from %s: %w", tokenFile, err)
+	}
+	return true, nil
+}
+
+// saveToken saves the Session's token in tokenFile, readable only by
+// the user since it is a credential.  The token is written to a new
+// file, which replaces tokenFile, so that an existing tokenFile with
+// looser permissions doesn't keep them.
+func saveToken(s *myq.Session) error {
+	// ioutil.TempFile creates the file readable only by the user
+	f, err := ioutil.TempFile(filepath.Dir(tokenFile), filepath.Base(tokenFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := s.SaveToken(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), tokenFile)
+}
+
+// Exit codes for -check, following the Nagios plugin conventions for
+// OK and WARNING
+const (
+	checkOK      = 0
+	checkWarning = 1
+	checkUnknown = 2
+)
+
+func fatal(err error) {
+	if check {
+		fmt.Printf("MYQ UNKNOWN - %v\n", err)
+		os.Exit(checkUnknown)
+	}
+
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	os.Exit(1)
+}
+
+func printVersion() {
+	version := "(unknown)"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version = bi.Main.Version
+		for _, dep := range bi.Deps {
+			if dep.Path == "github.com/joeshaw/myq" {
+				version = dep.Version
+			}
+		}
 	}
+
+	fmt.Printf("myq %s\n", version)
+	fmt.Printf("  OAuth client ID: %s\n", myq.OAuthClientID)
+	fmt.Printf("  OAuth redirect URIs: %s\n", strings.Join(myq.OAuthRedirectURIs, ", "))
+	fmt.Printf("  OAuth authorize endpoint: %s\n", myq.OAuthAuthorizeEndpoint)
+	fmt.Printf("  OAuth token endpoint: %s\n", myq.OAuthTokenEndpoint)
+	fmt.Printf("  Accounts endpoint: %s\n", myq.AccountsEndpoint)
+	fmt.Printf("  Devices endpoint: %s\n", fmt.Sprintf(myq.DevicesEndpointFmt, "<account>"))
 }
 
-func runDevices(s *myq.Session, args []string) error {
-	fmt.Println("Requesting devices from MyQ...")
+func runDevices(ctx context.Context, s *myq.Session, args []string) error {
+	if !jsonOutput {
+		fmt.Println("Requesting devices from MyQ...")
+	}
 
 	devices, err := s.Devices()
 	if err != nil {
 		return err
 	}
 
+	if !allDevices {
+		var openers []myq.Device
+		for _, d := range devices {
+			if d.IsDoorOpener() {
+				openers = append(openers, d)
+			}
+		}
+		devices = openers
+	}
+
+	if jsonOutput {
+		out := make([]jsonDevice, len(devices))
+		for i := range devices {
+			out[i] = newJSONDevice(&devices[i])
+		}
+		return printJSON(out)
+	}
+
 	if len(devices) == 0 {
 		fmt.Println("No devices found.")
 		return nil
@@ -110,23 +363,61 @@ func runDevices(s *myq.Session, args []string) error {
 
 	for _, d := range devices {
 		fmt.Printf("Device %s\n", d.SerialNumber)
-		fmt.Printf("  Account: %s\n", d.Account.Name)
+		fmt.Printf("  Account: %s (%s)\n", d.Account.Name, d.Account.ID)
 		fmt.Printf("  Name: %s\n", d.Name)
 		if d.DoorState != "" {
 			fmt.Printf("  Door State: %s\n", d.DoorState)
 		}
+		if d.LockState != "" {
+			fmt.Printf("  Lock State: %s\n", d.LockState)
+		}
+		if d.LampState != "" {
+			fmt.Printf("  Lamp State: %s\n", d.LampState)
+		}
+		fmt.Printf("  Online: %t\n", d.Online)
 		fmt.Println()
 	}
 
 	return nil
 }
 
-func runState(s *myq.Session, args []string) error {
-	if len(args) == 0 {
-		return errors.New("specify a MyQ device serial number")
+func runState(ctx context.Context, s *myq.Session, args []string) error {
+	serialNumber, err := deviceArg(s, args)
+	if err != nil {
+		return err
 	}
 
-	serialNumber := args[0]
+	if check {
+		d, err := s.DeviceBySerial(serialNumber)
+		if err != nil {
+			return err
+		}
+
+		switch d.DoorState {
+		case myq.StateClosed:
+			fmt.Printf("MYQ OK - %s is %s\n", d.Name, d.DoorState)
+			return exitStatus(checkOK)
+		case myq.StateOpen, myq.StateOpening, myq.StateClosing, myq.StateStopped:
+			fmt.Printf("MYQ WARNING - %s is %s\n", d.Name, d.DoorState)
+			return exitStatus(checkWarning)
+		default:
+			return fmt.Errorf("%s has door state %q", d.Name, d.DoorState)
+		}
+	}
+
+	if details || jsonOutput {
+		d, err := s.DeviceBySerial(serialNumber)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			return printJSON(newJSONDevice(d))
+		}
+
+		printDeviceDetails(d)
+		return nil
+	}
 
 	state, err := s.DeviceState(serialNumber)
 	if err != nil {
@@ -141,7 +432,130 @@ func runState(s *myq.Session, args []string) error {
 	return nil
 }
 
-func openOrClose(s *myq.Session, serialNumber string, action string) error {
+// jsonDevice is the -json representation of a device.  Its fields and
+// door state values are stable even if MyQ's wording changes.
+type jsonDevice struct {
+	SerialNumber string `json:"serial_number"`
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	Family       string `json:"family,omitempty"`
+	AccountID    string `json:"account_id,omitempty"`
+	AccountName  string `json:"account_name,omitempty"`
+
+	// DoorState is one of "open", "closed", "opening", "closing",
+	// "stopped" or "unknown", and is omitted for devices that aren't
+	// doors
+	DoorState string `json:"door_state,omitempty"`
+
+	LockState  string `json:"lock_state,omitempty"`
+	LampState  string `json:"lamp_state,omitempty"`
+	Online     bool   `json:"online"`
+	LastUpdate string `json:"last_update,omitempty"`
+}
+
+func newJSONDevice(d *myq.Device) jsonDevice {
+	jd := jsonDevice{
+		SerialNumber: d.SerialNumber,
+		Name:         d.Name,
+		Type:         d.Type,
+		Family:       d.Family,
+		LockState:    d.LockState,
+		LampState:    d.LampState,
+		Online:       d.Online,
+	}
+
+	if d.Account != nil {
+		jd.AccountID = d.Account.ID
+		jd.AccountName = d.Account.Name
+	}
+
+	switch d.DoorState {
+	case "":
+	case myq.StateOpen, myq.StateClosed, myq.StateOpening, myq.StateClosing, myq.StateStopped:
+		jd.DoorState = d.DoorState
+	default:
+		jd.DoorState = myq.StateUnknown
+	}
+
+	if !d.LastUpdate.IsZero() {
+		jd.LastUpdate = d.LastUpdate.UTC().Format(time.RFC3339)
+	}
+
+	return jd
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// deviceArg returns the serial number of the device given by the -name
+// flag, or otherwise by the first argument
+func deviceArg(s *myq.Session, args []string) (string, error) {
+	if deviceName != "" {
+		d, err := s.DeviceByName(deviceName)
+		if err != nil {
+			return "", err
+		}
+		return d.SerialNumber, nil
+	}
+
+	if len(args) == 0 {
+		return "", errors.New("specify a MyQ device serial number or name, or use -name")
+	}
+	return resolveDevice(s, args[0])
+}
+
+// resolveDevice returns the serial number of the device named by arg,
+// or arg itself if it is the serial number of a device
+func resolveDevice(s *myq.Session, arg string) (string, error) {
+	d, err := s.DeviceByName(arg)
+	if err == nil {
+		return d.SerialNumber, nil
+	}
+	if !errors.Is(err, myq.ErrDeviceNotFound) {
+		return "", err
+	}
+
+	exists, err := s.DeviceExists(arg)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		if suggestions := s.SuggestDevices(arg); len(suggestions) > 0 {
+			return "", fmt.Errorf("no device has serial number or name %q (did you mean %s?)", arg, strings.Join(suggestions, ", "))
+		}
+		return "", fmt.Errorf("no device has serial number or name %q", arg)
+	}
+	return arg, nil
+}
+
+func printDeviceDetails(d *myq.Device) {
+	fmt.Printf("Device %s\n", d.SerialNumber)
+	fmt.Printf("  Account: %s (%s)\n", d.Account.Name, d.Account.ID)
+	fmt.Printf("  Name: %s\n", d.Name)
+	fmt.Printf("  Type: %s\n", d.Type)
+	if d.Model != "" {
+		fmt.Printf("  Model: %s\n", d.Model)
+	}
+	if d.HardwareVersion != "" {
+		fmt.Printf("  Hardware Version: %s\n", d.HardwareVersion)
+	}
+	if d.DoorState != "" {
+		fmt.Printf("  Door State: %s\n", d.DoorState)
+	}
+	fmt.Printf("  Online: %t\n", d.Online)
+	if !d.LastUpdate.IsZero() {
+		fmt.Printf("  Last Update: %s\n", d.LastUpdate.Local().Format(time.RFC1123))
+	}
+	fmt.Printf("  Low Battery: %t\n", d.LowBattery)
+	if d.LastChangeTrigger != "" {
+		fmt.Printf("  Last Change Trigger: %s\n", d.LastChangeTrigger)
+	}
+}
+
+func openOrClose(ctx context.Context, s *myq.Session, serialNumber string, action string) error {
 	var desiredState string
 	switch action {
 	case myq.ActionOpen:
@@ -150,16 +564,58 @@ func openOrClose(s *myq.Session, serialNumber string, action string) error {
 		desiredState = myq.StateClosed
 	}
 
-	if err := s.SetDoorState(serialNumber, action); err != nil {
+	d, err := s.DeviceBySerial(serialNumber)
+	if err != nil {
+		return err
+	}
+
+	if d.CommandPending {
+		return errors.New("door has a command pending")
+	}
+	if d.InMotion() {
+		return fmt.Errorf("door is currently %s", d.DoorState)
+	}
+
+	if d.DoorState == desiredState {
+		fmt.Printf("Door is already %s\n", desiredState)
+		return nil
+	}
+
+	if confirm && !assumeYes {
+		ok, err := confirmAction(fmt.Sprintf("%s %q?", strings.ToUpper(action[:1])+action[1:], d.Name))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("Canceled.")
+			return nil
+		}
+	}
+
+	commandID, err := s.SetDoorStateCommand(serialNumber, action)
+	if err != nil {
 		return err
 	}
 
 	fmt.Printf("Waiting for door to be %s...\n", desiredState)
 
-	var currentState string
+	// The overall wait is separate from the -timeout on each of the
+	// requests made while waiting
 	deadline := time.Now().Add(60 * time.Second)
+
+	if commandID != "" {
+		return waitForCommand(ctx, s, serialNumber, commandID, desiredState, deadline)
+	}
+
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+
+	var currentState string
 	for time.Now().Before(deadline) {
-		state, err := s.DeviceState(serialNumber)
+		state, err := s.DeviceStateContext(ctx, serialNumber)
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("stopped waiting for door to be %s: %w", desiredState, ctx.Err())
+		}
 		if err != nil {
 			return err
 		}
@@ -172,7 +628,12 @@ func openOrClose(s *myq.Session, serialNumber string, action string) error {
 		if currentState == desiredState {
 			break
 		}
-		time.Sleep(5 * time.Second)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for door to be %s: %w", desiredState, ctx.Err())
+		case <-t.C:
+		}
 	}
 
 	if currentState != desiredState {
@@ -182,18 +643,254 @@ func openOrClose(s *myq.Session, serialNumber string, action string) error {
 	return nil
 }
 
-func runOpen(s *myq.Session, args []string) error {
-	if len(args) == 0 {
-		return errors.New("specify a MyQ device serial number")
+// confirmAction asks the user the provided question on the terminal
+// and reports whether they answered yes
+func confirmAction(question string) (bool, error) {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false, errors.New("-confirm requires a terminal; use -yes to proceed without confirmation")
+	}
+
+	fmt.Printf("%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return false, err
 	}
 
-	return openOrClose(s, args[0], myq.ActionOpen)
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
 }
 
-func runClose(s *myq.Session, args []string) error {
-	if len(args) == 0 {
-		return errors.New("specify a MyQ device serial number")
+// waitForCommand waits for MyQ to report that the command with the
+// provided ID completed
+func waitForCommand(ctx context.Context, s *myq.Session, serialNumber, commandID, desiredState string, deadline time.Time) error {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+
+	for time.Now().Before(deadline) {
+		status, err := s.CommandStatusContext(ctx, serialNumber, commandID)
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("stopped waiting for door to be %s: %w", desiredState, ctx.Err())
+		}
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case myq.CommandCompleted:
+			fmt.Printf("Door is %s\n", desiredState)
+			return nil
+		case myq.CommandFailed:
+			return fmt.Errorf("MyQ failed to make the door %s", desiredState)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for door to be %s: %w", desiredState, ctx.Err())
+		case <-t.C:
+		}
+	}
+
+	return fmt.Errorf("timed out waiting for door to be %s", desiredState)
+}
+
+func runOpen(ctx context.Context, s *myq.Session, args []string) error {
+	serialNumber, err := deviceArg(s, args)
+	if err != nil {
+		return err
+	}
+
+	return openOrClose(ctx, s, serialNumber, myq.ActionOpen)
+}
+
+func runClose(ctx context.Context, s *myq.Session, args []string) error {
+	serialNumber, err := deviceArg(s, args)
+	if err != nil {
+		return err
 	}
 
-	return openOrClose(s, args[0], myq.ActionClose)
+	return openOrClose(ctx, s, serialNumber, myq.ActionClose)
+}
+
+func runStop(ctx context.Context, s *myq.Session, args []string) error {
+	serialNumber, err := deviceArg(s, args)
+	if err != nil {
+		return err
+	}
+
+	if err := s.SetDoorState(serialNumber, myq.ActionStop); err != nil {
+		return err
+	}
+
+	fmt.Printf("Door %s stopped\n", serialNumber)
+	return nil
+}
+
+func runLampOn(ctx context.Context, s *myq.Session, args []string) error {
+	return setLamp(s, args, myq.StateOn)
+}
+
+func runLampOff(ctx context.Context, s *myq.Session, args []string) error {
+	return setLamp(s, args, myq.StateOff)
+}
+
+func setLamp(s *myq.Session, args []string, state string) error {
+	serialNumber, err := deviceArg(s, args)
+	if err != nil {
+		return err
+	}
+
+	if err := s.SetLampState(serialNumber, state); err != nil {
+		return err
+	}
+
+	fmt.Printf("Lamp %s turned %s\n", serialNumber, state)
+	return nil
+}
+
+func runWatch(ctx context.Context, s *myq.Session, args []string) error {
+	if monitorInterval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	serialNumber, err := deviceArg(s, args)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Watching %s every %v...\n", serialNumber, monitorInterval)
+	setJitter()
+
+	states, errs := s.Watch(ctx, serialNumber, monitorInterval)
+	for states != nil || errs != nil {
+		select {
+		case state, ok := <-states:
+			if !ok {
+				states = nil
+				continue
+			}
+			fmt.Printf("%s: %s is %s\n", time.Now().Format(time.RFC3339), serialNumber, state)
+
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		}
+	}
+
+	fmt.Println("Stopped watching.")
+	return nil
+}
+
+// setJitter sets the library's poll jitter to -jitter, which is given
+// as a duration rather than a fraction of -interval
+func setJitter() {
+	myq.PollJitter = 0
+	if monitorJitter > 0 {
+		myq.PollJitter = float64(monitorJitter) / float64(monitorInterval)
+	}
+}
+
+func runMonitor(ctx context.Context, s *myq.Session, args []string) error {
+	if monitorInterval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	fmt.Printf("Monitoring doors every %v...\n", monitorInterval)
+
+	type doorStatus struct {
+		state      string
+		openSince  time.Time
+		reportedAt time.Duration
+	}
+	doors := map[string]*doorStatus{}
+
+	setJitter()
+
+	t := time.NewTimer(myq.Jitter(monitorInterval))
+	defer t.Stop()
+
+	for {
+		devices, err := s.DevicesContext(ctx)
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		}
+
+		now := time.Now()
+		for _, d := range devices {
+			if !d.IsDoorOpener() {
+				continue
+			}
+
+			ds, ok := doors[d.SerialNumber]
+			if !ok {
+				ds = &doorStatus{}
+				doors[d.SerialNumber] = ds
+			}
+
+			if d.DoorState == myq.StateOpen && ds.state != myq.StateOpen {
+				ds.openSince = now
+				ds.reportedAt = 0
+				fmt.Printf("%s: %s (%s) is open\n", now.Format(time.RFC3339), d.Name, d.SerialNumber)
+			}
+
+			if d.DoorState == myq.StateOpen && openThreshold > 0 {
+				// Report each time the door has been open for
+				// another multiple of the threshold.
+				if open := now.Sub(ds.openSince); open-ds.reportedAt >= openThreshold {
+					ds.reportedAt = open.Truncate(openThreshold)
+					fmt.Printf("%s: %s (%s) has been open for %v\n", now.Format(time.RFC3339), d.Name, d.SerialNumber, open.Round(time.Second))
+				}
+			}
+
+			ds.state = d.DoorState
+		}
+
+		select {
+		case <-ctx.Done():
+			var open []string
+			for serialNumber, ds := range doors {
+				if ds.state == myq.StateOpen {
+					open = append(open, serialNumber)
+				}
+			}
+			sort.Strings(open)
+
+			fmt.Println("Stopped monitoring.")
+			if len(open) == 0 {
+				return nil
+			}
+
+			fmt.Printf("Doors last seen open: %s\n", strings.Join(open, ", "))
+			if !closeAllOnExit {
+				return nil
+			}
+
+			var failed bool
+			for _, serialNumber := range open {
+				fmt.Printf("Closing %s...\n", serialNumber)
+				if err := s.SetDoorState(serialNumber, myq.ActionClose); err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: closing %s: %v\n", serialNumber, err)
+					failed = true
+				}
+			}
+			if failed {
+				return errors.New("not all doors could be closed")
+			}
+			return nil
+
+		case <-t.C:
+			t.Reset(myq.Jitter(monitorInterval))
+		}
+	}
 }
@@ -0,0 +1,54 @@
+package myq
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Parameters are account ID, device serial number and command ID
+const commandEndpointFmt = doorOpenersHost + "/api/v5.2/Accounts/%s/door_openers/%s/commands/%s"
+
+// Command statuses returned by CommandStatus
+const (
+	CommandPending   = "pending"
+	CommandCompleted = "completed"
+	CommandFailed    = "failed"
+)
+
+// CommandStatus returns the status of a command returned by
+// SetDoorStateCommand, such as CommandPending or CommandCompleted.
+// Unlike the door state, it tells whether that particular command
+// completed.
+func (s *Session) CommandStatus(serialNumber, commandID string) (string, error) {
+	return s.CommandStatusContext(context.Background(), serialNumber, commandID)
+}
+
+// CommandStatusContext is like CommandStatus, but gives up when ctx is
+// done
+func (s *Session) CommandStatusContext(ctx context.Context, serialNumber, commandID string) (string, error) {
+	acct, err := s.deviceAccount(ctx, serialNumber)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := s.versioned(fmt.Sprintf(commandEndpointFmt, acct.ID, serialNumber, commandID))
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var body struct {
+		Status string `json:"status"`
+	}
+
+	if err := s.apiRequestWithRetry(req, &body); err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return "", fmt.Errorf("command %s for device %s not found", commandID, serialNumber)
+		}
+		return "", err
+	}
+
+	return strings.ToLower(body.Status), nil
+}
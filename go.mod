@@ -1,5 +1,5 @@
 module github.com/joeshaw/myq
 
-go 1.12
+go 1.13
 
 require golang.org/x/net v0.0.0-20210917221730-978cfadd31cf
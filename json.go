@@ -0,0 +1,66 @@
+package myq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// MyQ has been inconsistent in how it encodes values, at times sending
+// booleans and numbers as strings.  These types decode the variations
+// seen so that a formatting change on MyQ's side doesn't break parsing.
+
+// jsonBool decodes true, 1, "true", and "1" (and their false
+// counterparts) as a bool.  null and "" decode as false.
+type jsonBool bool
+
+func (b *jsonBool) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		data = []byte(s)
+	}
+
+	switch string(bytes.ToLower(data)) {
+	case "true", "1":
+		*b = true
+	case "false", "0", "null", "":
+		*b = false
+	default:
+		return fmt.Errorf("myq: cannot decode %s as a bool", data)
+	}
+	return nil
+}
+
+// jsonString decodes strings, numbers, and booleans as a string.  null
+// decodes as "".
+type jsonString string
+
+func (s *jsonString) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) > 0 && data[0] == '"':
+		var v string
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*s = jsonString(v)
+
+	case string(data) == "null":
+		*s = ""
+
+	case string(data) == "true" || string(data) == "false":
+		*s = jsonString(data)
+
+	default:
+		if _, err := strconv.ParseFloat(string(data), 64); err != nil {
+			return fmt.Errorf("myq: cannot decode %s as a string", data)
+		}
+		*s = jsonString(data)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package myq
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONBool(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    bool
+		wantErr bool
+	}{
+		{`true`, true, false},
+		{`false`, false, false},
+		{`1`, true, false},
+		{`0`, false, false},
+		{`"true"`, true, false},
+		{`"false"`, false, false},
+		{`"True"`, true, false},
+		{`"1"`, true, false},
+		{`"0"`, false, false},
+		{`""`, false, false},
+		{`null`, false, false},
+		{`2`, false, true},
+		{`"yes"`, false, true},
+		{`{}`, false, true},
+	}
+
+	for _, tt := range tests {
+		var b jsonBool
+		err := json.Unmarshal([]byte(tt.in), &b)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if bool(b) != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.in, b, tt.want)
+		}
+	}
+}
+
+func TestJSONString(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{`"closed"`, "closed", false},
+		{`""`, "", false},
+		{`null`, "", false},
+		{`829`, "829", false},
+		{`"829"`, "829", false},
+		{`1.5`, "1.5", false},
+		{`true`, "true", false},
+		{`false`, "false", false},
+		{`{}`, "", true},
+		{`[]`, "", true},
+	}
+
+	for _, tt := range tests {
+		var s jsonString
+		err := json.Unmarshal([]byte(tt.in), &s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if string(s) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.in, s, tt.want)
+		}
+	}
+}
+
+// The same device encoded with native values and with them as strings
+func TestDeviceStateEncodings(t *testing.T) {
+	fixtures := map[string]string{
+		"native": `{
+			"serial_number": "CG0812345678",
+			"device_family": "garagedoor",
+			"device_model": 829,
+			"state": {"door_state": "closed", "online": true, "dps_low_battery_mode": 1, "command_pending": true}
+		}`,
+		"strings": `{
+			"serial_number": "CG0812345678",
+			"device_family": "garagedoor",
+			"device_model": "829",
+			"state": {"door_state": "closed", "online": "true", "dps_low_battery_mode": "1", "command_pending": "true"}
+		}`,
+	}
+
+	for name, fixture := range fixtures {
+		var dj deviceJSON
+		if err := json.Unmarshal([]byte(fixture), &dj); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		d := dj.device(nil)
+		if d.StateError != nil {
+			t.Fatalf("%s: %v", name, d.StateError)
+		}
+		if d.Model != "829" || !d.Online || !d.LowBattery || !d.CommandPending || d.DoorState != StateClosed {
+			t.Errorf("%s: got %+v", name, d)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package myq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// listAll fetches every item from a MyQ list endpoint, following the
+// next links of paginated responses, and passes each to decodeItem in
+// order.  Next links may be relative, but must stay on the endpoint's
+// host, since the token is sent with each page's request.
+func (s *Session) listAll(ctx context.Context, endpoint string, decodeItem func(json.RawMessage) error) error {
+	seen := map[string]bool{}
+
+	for endpoint != "" {
+		if seen[endpoint] {
+			return fmt.Errorf("pagination loop at %s", endpoint)
+		}
+		seen[endpoint] = true
+
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+		if err != nil {
+			return err
+		}
+
+		var page struct {
+			Items []json.RawMessage `json:"items"`
+			Next  string            `json:"next"`
+		}
+
+		if err := s.apiRequestWithRetry(req, &page); err != nil {
+			return err
+		}
+
+		for _, item := range page.Items {
+			if err := decodeItem(item); err != nil {
+				return err
+			}
+		}
+
+		endpoint = ""
+		if page.Next != "" {
+			next, err := req.URL.Parse(page.Next)
+			if err != nil {
+				return err
+			}
+			if next.Scheme != req.URL.Scheme || next.Host != req.URL.Host {
+				return fmt.Errorf("pagination link to another host: %s", next.Host)
+			}
+			endpoint = next.String()
+		}
+	}
+
+	return nil
+}
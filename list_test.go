@@ -0,0 +1,132 @@
+package myq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pagedHandler serves pages, keyed by their request URI, recording the
+// host and URI of each request
+type pagedHandler struct {
+	pages map[string]string
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (h *pagedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.requests = append(h.requests, r.Host+r.URL.RequestURI())
+	h.mu.Unlock()
+
+	page, ok := h.pages[r.URL.RequestURI()]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(page))
+}
+
+const listEndpoint = devicesHost + "/api/v5.2/Accounts/1/Devices"
+
+func listItems(s *Session) ([]string, error) {
+	var items []string
+	err := s.listAll(context.Background(), listEndpoint, func(item json.RawMessage) error {
+		var v string
+		if err := json.Unmarshal(item, &v); err != nil {
+			return err
+		}
+		items = append(items, v)
+		return nil
+	})
+	return items, err
+}
+
+func TestListAllPages(t *testing.T) {
+	h := &pagedHandler{pages: map[string]string{
+		// An absolute link, a path, and a query relative to the page
+		"/api/v5.2/Accounts/1/Devices":        `{"items":["a","b"],"next":"` + listEndpoint + `?page=2"}`,
+		"/api/v5.2/Accounts/1/Devices?page=2": `{"items":["c"],"next":"/api/v5.2/Accounts/1/Devices?page=3"}`,
+		"/api/v5.2/Accounts/1/Devices?page=3": `{"items":[],"next":"?page=4"}`,
+		"/api/v5.2/Accounts/1/Devices?page=4": `{"items":["d"]}`,
+	}}
+
+	s, srv := testSession(t, h)
+	defer srv.Close()
+
+	items, err := listItems(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(items, ","); got != "a,b,c,d" {
+		t.Errorf("got items %s, want a,b,c,d", got)
+	}
+	if len(h.requests) != 4 {
+		t.Errorf("got requests %q, want 4", h.requests)
+	}
+}
+
+func TestListAllSinglePage(t *testing.T) {
+	h := &pagedHandler{pages: map[string]string{
+		"/api/v5.2/Accounts/1/Devices": `{"items":["a"],"next":""}`,
+	}}
+
+	s, srv := testSession(t, h)
+	defer srv.Close()
+
+	items, err := listItems(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || len(h.requests) != 1 {
+		t.Errorf("got items %q after requests %q", items, h.requests)
+	}
+}
+
+func TestListAllLoop(t *testing.T) {
+	h := &pagedHandler{pages: map[string]string{
+		"/api/v5.2/Accounts/1/Devices":        `{"items":["a"],"next":"?page=2"}`,
+		"/api/v5.2/Accounts/1/Devices?page=2": `{"items":["b"],"next":"` + listEndpoint + `"}`,
+	}}
+
+	s, srv := testSession(t, h)
+	defer srv.Close()
+
+	_, err := listItems(s)
+	if err == nil || !strings.Contains(err.Error(), "pagination loop") {
+		t.Fatalf("got error %v, want a pagination loop", err)
+	}
+	if len(h.requests) != 2 {
+		t.Errorf("got requests %q, want 2", h.requests)
+	}
+}
+
+// The token must not be sent to a host a next link points at
+func TestListAllOtherHost(t *testing.T) {
+	for _, next := range []string{
+		"https://devices.example.com/api/v5.2/Accounts/1/Devices?page=2",
+		"//devices.example.com/page2",
+		"http://devices.myq-cloud.com/api/v5.2/Accounts/1/Devices?page=2",
+	} {
+		h := &pagedHandler{pages: map[string]string{
+			"/api/v5.2/Accounts/1/Devices": fmt.Sprintf(`{"items":["a"],"next":%q}`, next),
+		}}
+
+		s, srv := testSession(t, h)
+
+		if _, err := listItems(s); err == nil || !strings.Contains(err.Error(), "another host") {
+			t.Errorf("%s: got error %v, want it refused", next, err)
+		}
+		if len(h.requests) != 1 {
+			t.Errorf("%s: got requests %q, want only the first page", next, h.requests)
+		}
+
+		srv.Close()
+	}
+}
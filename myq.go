@@ -1,57 +1,415 @@
 package myq
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	accountsEndpoint = "https://accounts.myq-cloud.com/api/v6.0/accounts"
+	accountsHost    = "https://accounts.myq-cloud.com"
+	devicesHost     = "https://devices.myq-cloud.com"
+	doorOpenersHost = "https://account-devices-gdo.myq-cloud.com"
+	gatewaysHost    = "https://account-devices-gateway.myq-cloud.com"
 
-	// Parameter is account ID
-	devicesEndpointFmt = "https://devices.myq-cloud.com/api/v5.2/Accounts/%s/Devices"
+	// AccountsEndpoint is the MyQ endpoint listing the user's accounts
+	AccountsEndpoint = accountsHost + "/api/v6.0/accounts"
+
+	// DevicesEndpointFmt is the MyQ endpoint listing an account's
+	// devices.  Parameter is account ID.
+	DevicesEndpointFmt = devicesHost + "/api/v5.2/Accounts/%s/Devices"
 
 	// Parameters are account ID and device serial number
-	deviceEndpointFmt = "https://devices.myq-cloud.com/api/v5.2/Accounts/%s/Devices/%s"
+	deviceEndpointFmt = devicesHost + "/api/v5.2/Accounts/%s/Devices/%s"
 
 	// Parameters are account ID, device serial number, and action (open or close)
-	deviceActionsEndpointFmt = "https://account-devices-gdo.myq-cloud.com/api/v5.2/Accounts/%s/door_openers/%s/%s"
+	deviceActionsEndpointFmt = doorOpenersHost + "/api/v5.2/Accounts/%s/door_openers/%s/%s"
+
+	// Parameters are account ID, gateway serial number, and action (reboot)
+	gatewayActionsEndpointFmt = gatewaysHost + "/api/v5.2/Accounts/%s/gateways/%s/%s"
 )
 
 const (
-	ActionClose = "close"
-	ActionOpen  = "open"
+	ActionClose  = "close"
+	ActionOpen   = "open"
+	ActionReboot = "reboot"
+
+	// ActionStop halts a door partway through opening or closing.
+	// Not all openers support it.
+	ActionStop = "stop"
 
 	StateUnknown = "unknown"
 	StateOpen    = "open"
 	StateClosed  = "closed"
 	StateStopped = "stopped"
+	StateOpening = "opening"
+	StateClosing = "closing"
+)
+
+// normalizeDoorState maps the variations in wording MyQ has used for
+// door states over time onto the State constants.  Unrecognized states
+// are passed through in lower case.
+func normalizeDoorState(state string) string {
+	state = strings.ToLower(strings.TrimSpace(state))
+	switch state {
+	case "opened":
+		return StateOpen
+	case "close":
+		return StateClosed
+	case "stop":
+		return StateStopped
+	default:
+		return state
+	}
+}
+
+const defaultMaxConcurrency = 4
+
+// Versions of the MyQ APIs in the endpoints above: accountsHost serves
+// the accounts API, and the other hosts the devices API
+const (
+	defaultAccountsAPIVersion = "v6.0"
+	defaultDevicesAPIVersion  = "v5.2"
+)
+
+// Default timeouts for Session operations
+const (
+	defaultReadTimeout  = 30 * time.Second
+	defaultWriteTimeout = 30 * time.Second
+	defaultLoginTimeout = 60 * time.Second
+)
+
+// tokenExpirySkew is how long before its expiry a token is no longer
+// considered valid, to allow for clock skew and requests in flight
+const tokenExpirySkew = time.Minute
+
+// Steps of the login flow reported to Session.OnLoginStep
+const (
+	LoginStepAuthorize         = "authorization started"
+	LoginStepVerificationToken = "verification token obtained"
+	LoginStepCredentials       = "credentials submitted"
+	LoginStepToken             = "token received"
 )
 
 var (
 	// Debug indiciates whether to log HTTP responses to stderr
 	Debug = false
 
+	// Recorder, if not nil, records every HTTP request made to MyQ
+	// and its response
+	Recorder *Transcript
+
+	// MaxResponseSize is the largest response body, in bytes, that
+	// will be read from MyQ.  Larger responses fail with
+	// ErrResponseTooLarge.
+	MaxResponseSize int64 = 10 << 20
+
 	// ErrNotLoggedIn is returned whenever an operation is run the
-	// user has not logged in
+	// user has not logged in.  Like other errors from requests to
+	// MyQ, it is wrapped in a *RequestError, so use errors.Is to test
+	// for it.
 	ErrNotLoggedIn = errors.New("not logged in")
+
+	// ErrMissingCredentials is returned by Login when the Session's
+	// Username or Password is empty
+	ErrMissingCredentials = errors.New("username and password are required")
+
+	// ErrForbidden is returned, wrapped, when MyQ refuses an operation
+	// the logged in user is not permitted to perform, such as
+	// controlling a device in an account they can only view.  Logging
+	// in again will not help.  Use errors.Is to test for it.
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrSubscriptionRequired is returned, wrapped, when an operation
+	// requires a paid MyQ subscription the account doesn't have.  Use
+	// errors.Is to test for it.
+	ErrSubscriptionRequired = errors.New("MyQ subscription required")
+
+	// ErrStaleState is returned by DeviceStateFresh when the most
+	// recent state reported by the device is older than requested
+	ErrStaleState = errors.New("device state is stale")
+
+	// ErrReadOnly is returned when attempting to change the state of
+	// a device with a read-only Session
+	ErrReadOnly = errors.New("session is read-only")
+
+	// ErrDeviceNotFound is returned, wrapped, when no device matches
+	// the requested device
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrInvalidCredentials is returned by Login when MyQ rejects
+	// the username or password
+	ErrInvalidCredentials = errors.New("invalid MyQ username or password")
+
+	// ErrAmbiguousName is returned, wrapped, by DeviceByName when the
+	// name matches more than one device
+	ErrAmbiguousName = errors.New("matches multiple devices")
+
+	// ErrInMotion is returned, wrapped, by SetDoorState when the
+	// Session's RefuseInMotion option is set and the door is opening
+	// or closing, or has a command pending
+	ErrInMotion = errors.New("door is in motion")
+
+	// ErrDuplicateAction is returned by SetDoorState when the same
+	// action was issued to the same device within the Session's
+	// DebounceWindow
+	ErrDuplicateAction = errors.New("duplicate action ignored")
+
+	// ErrResponseTooLarge is returned when reading a response body
+	// longer than MaxResponseSize
+	ErrResponseTooLarge = errors.New("response body too large")
+
+	// ErrConsentRequired is returned by Login when MyQ requires the
+	// user to accept new terms before logging in.  Logging into the
+	// MyQ app once and accepting them resolves it.
+	ErrConsentRequired = errors.New("MyQ requires accepting new terms; log into the MyQ app once to accept them")
+
+	// ErrHTMLResponse is returned, wrapped with the start of the
+	// page, when MyQ responds with an HTML page instead of JSON, as
+	// its CDN does during outages
+	ErrHTMLResponse = errors.New("unexpected HTML response from MyQ")
+
+	// ErrActionAccepted is returned by SetDoorState, when the
+	// Session's ReturnAccepted option is set, to indicate that MyQ
+	// accepted the command but has not yet carried it out.  It
+	// signifies success; callers should poll the device state to
+	// learn when the command completes.
+	ErrActionAccepted = errors.New("action accepted")
 )
 
+// Controller is the set of operations for reading and controlling
+// doors.  It is implemented by Session, and by myqtest.FakeSession for
+// testing code that uses this package.
+type Controller interface {
+	Devices() ([]Device, error)
+	DeviceState(serialNumber string) (string, error)
+	SetDoorState(serialNumber string, action string) error
+}
+
+var _ Controller = (*Session)(nil)
+
+// Logger is the interface used by Session to log retry events
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
 // Session represents an authenticated session to the MyQ service.
+//
+// A Session caches its token and the user's accounts, and is not safe
+// for concurrent use by multiple goroutines.  Use Clone to give each
+// goroutine (or tenant) its own Session with the same configuration.
 type Session struct {
 	Username string
 	Password string
 
-	token    string
-	accounts []*Account
+	// DebounceWindow, if non-zero, causes SetDoorState to ignore an
+	// action identical to one successfully issued to the same device
+	// within the window, returning ErrDuplicateAction instead.  This
+	// protects a door in motion from a double-triggered command.
+	DebounceWindow time.Duration
+
+	// ReadOnly prevents the Session from changing the state of any
+	// device: actions such as SetDoorState fail with ErrReadOnly
+	// before the action request is issued, while reads work
+	// normally.  Use it for dashboards and monitoring that should
+	// never move a door.
+	ReadOnly bool
+
+	// RefuseInMotion causes SetDoorState, and OpenDoorByName and
+	// CloseDoorByName, to read the door's state before opening or
+	// closing it, and to refuse with ErrInMotion if it is opening,
+	// closing or has a command pending, since a command issued to a
+	// door in motion can leave it in an unexpected state.  ActionStop
+	// is always sent.  Otherwise, callers that want this protection
+	// must check Device.InMotion themselves.
+	RefuseInMotion bool
+
+	// ReturnAccepted causes SetDoorState to return ErrActionAccepted
+	// instead of nil when MyQ accepts a command for asynchronous
+	// processing (HTTP 202 or 204), making explicit that the door has
+	// not necessarily moved yet.
+	ReturnAccepted bool
+
+	// PKCEMethod is the PKCE code challenge method used when logging
+	// in, PKCEMethodS256 (the default) or PKCEMethodPlain.
+	PKCEMethod string
+
+	// PKCEVerifier, if set, is the PKCE code verifier used when
+	// logging in instead of a randomly generated one.  This is mainly
+	// useful for reproducing a login in tests; a fixed verifier
+	// defeats the purpose of PKCE.
+	PKCEVerifier string
+
+	// CookieJar, if set, holds the MyQ identity service cookies used
+	// while logging in.  By default each login starts with an empty
+	// jar.  Supplying a jar that persists across logins lets the
+	// identity service recognize the device, for instance with a
+	// "remember this device" cookie that skips repeated MFA prompts.
+	//
+	// Persisted login cookies are credentials in their own right:
+	// anyone who can read them may be able to complete a login
+	// without the second factor, so store them as carefully as the
+	// password.
+	CookieJar http.CookieJar
+
+	// Brand is the brand of the user's MyQ devices, whose app's OAuth
+	// client is used to log in: "liftmaster" (the default),
+	// "chamberlain" or "craftsman".  Only the LiftMaster app's client
+	// is known, so all three currently log in with it, and setting
+	// Brand has no effect beyond rejecting unknown brands.
+	Brand string
+
+	// Locale is the language of the MyQ login page, such as "en-US",
+	// requested with the ui_locales parameter.  If empty, "en-US" is
+	// used, since the login form is parsed from the page and other
+	// locales may lay it out differently.
+	Locale string
+
+	// OnLoginStep, if set, is called as each step of the login flow
+	// completes, with one of the LoginStep constants
+	OnLoginStep func(step string)
+
+	// CacheTTL is how long Devices and the other methods listing all
+	// devices reuse the last list fetched before fetching it again.
+	// If zero, the list is fetched every time.  Methods for a single
+	// device, such as DeviceState, always fetch its current state.
+	CacheTTL time.Duration
+
+	// AccountsTTL is how long the user's accounts are cached before
+	// being fetched again.  If zero, they are fetched once and cached
+	// for the life of the Session, which saves a request per
+	// operation but means a long-running program won't see accounts
+	// the user gains or loses access to unless it calls
+	// RefreshAccounts.
+	AccountsTTL time.Duration
+
+	// Timeout bounds how long each request to the MyQ API may take,
+	// unless overridden by ReadTimeout or WriteTimeout.  If zero, it
+	// is 30 seconds.
+	Timeout time.Duration
+
+	// ReadTimeout, WriteTimeout, and LoginTimeout bound how long
+	// requests may take: reads of devices and accounts, actions that
+	// change a device, and the whole login flow (or a token refresh),
+	// respectively.  Each defaults to a sensible value if zero.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	LoginTimeout time.Duration
+
+	// Logger, if set, receives log entries for retries: when a
+	// request is retried after renewing the token, or after being
+	// rate limited.  Entries are key=value formatted.  A *log.Logger
+	// satisfies this interface.
+	Logger Logger
+
+	// MaxConcurrency bounds the number of requests the Session issues
+	// to MyQ at once for operations that span several accounts or
+	// devices.  MyQ rate limits aggressively.  If zero, a default of 4
+	// is used.
+	MaxConcurrency int
+
+	// HTTPClient, if set, is used for all requests to MyQ, including
+	// those made while logging in, instead of http.DefaultClient.
+	// While logging in, its cookie jar and redirect policy are
+	// replaced with the login flow's own.  Dialer and IPv4Only have
+	// no effect when it is set.
+	HTTPClient *http.Client
+
+	// Dialer, if set, is used to connect to MyQ, for instance to bind
+	// connections to a particular local address with its LocalAddr
+	Dialer *net.Dialer
+
+	// DeduplicateDevices causes Devices and the other methods listing
+	// devices to include a device shared between several of the
+	// user's accounts only once, with the first of them.  Otherwise
+	// it is listed once per account, with each Account.  Actions on
+	// the device are always sent to the first account.
+	DeduplicateDevices bool
+
+	// AccountsAPIVersion and DevicesAPIVersion, if set, override the
+	// versions of the MyQ accounts API ("v6.0") and devices API
+	// ("v5.2") used, as an emergency fix when MyQ retires a version.
+	// Other versions may respond differently, breaking parsing.
+	AccountsAPIVersion string
+	DevicesAPIVersion  string
+
+	// IPv4Only restricts connections to MyQ to IPv4, for networks
+	// where logins hang when connecting over IPv6
+	IPv4Only bool
+
+	// client is the HTTP client created for Dialer and IPv4Only
+	client *http.Client
+
+	// now, if set, is used in place of time.Now to expire the
+	// cached accounts and devices, for tests
+	now func() time.Time
+
+	token        string
+	tokenExpiry  time.Time
+	refreshToken string
+	scope        string
+	accounts     []*Account
+	accountsAt   time.Time
+
+	// oauth holds the material from the most recent login flow: the
+	// PKCE code verifier and the identity service cookies.  It is
+	// used to exchange the refresh token for a new token.  MyQ's
+	// token endpoint does not currently require the code verifier
+	// after the initial code exchange, but some OAuth flows require
+	// it to be presented again with follow-up token requests, so it
+	// is retained for the life of the Session rather than discarded
+	// once Login returns.
+	oauth *oauth
+
+	mu          sync.Mutex
+	renewing    *renewal
+	lastActions map[string]lastAction
+	observed    map[string]observedState
+
+	// deviceAccounts maps device serial numbers to the account
+	// containing the device
+	deviceAccounts map[string]*Account
+
+	// lastDevices is the result of the last successful fetch of
+	// all devices, at lastDevicesAt
+	lastDevices   []Device
+	lastDevicesAt time.Time
+
+	// devicesCachedAt is when lastDevices was fetched, if it may be
+	// returned from the CacheTTL cache.  Refresh clears it, keeping
+	// lastDevices for DevicesOrLast to fall back to.
+	devicesCachedAt time.Time
+}
+
+type lastAction struct {
+	action string
+	at     time.Time
+}
+
+// observedState records when the Session saw a device's door state
+// change
+type observedState struct {
+	state     string
+	changedAt time.Time
 }
 
+// Account is a MyQ account, typically a household, that devices
+// belong to.  A user may have access to several.
 type Account struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
@@ -62,17 +420,279 @@ type Device struct {
 	Account      *Account
 	SerialNumber string
 	Type         string
-	Name         string
-	DoorState    string
+	Family       string
+	Model        string
+
+	// Name is the device's name from the top-level "name" field of
+	// the devices endpoint, which is the name shown in the MyQ app.
+	// A rename in the app can take a few minutes to be reflected.
+	Name string
+
+	DoorState string
+	LockState string
+	Online    bool
+
+	// LampState is StateOn or StateOff for lamp modules, and empty
+	// for other devices
+	LampState string
+
+	// CommandPending is set when MyQ reports that a command sent to
+	// the device has been accepted but not yet carried out, for
+	// instance while the door's alarm sounds before it starts to
+	// close
+	CommandPending bool
+
+	// HardwareVersion is the device's hardware revision, if MyQ
+	// reports it
+	HardwareVersion string
+
+	// LowBattery indicates that the battery in the door position
+	// sensor is low
+	LowBattery bool
+
+	// LastUpdate is when the device last reported its state to
+	// MyQ.  It is the zero time if MyQ did not provide it.
+	LastUpdate time.Time
+
+	// LastChangeTrigger is what caused the last change in the
+	// device's state, such as "manual", "schedule" or "auto" for a
+	// door closed by a timer-to-close rule.  It is empty if MyQ did
+	// not provide it.
+	LastChangeTrigger string
+
+	// Location is where the device is installed, for accounts that
+	// record it.  Its fields are empty otherwise.
+	Location Location
+
+	// StateError is set if the device's state could not be parsed,
+	// in which case DoorState is StateUnknown and the other state
+	// fields are unset.  The device's identifying information is
+	// still valid.
+	StateError error
+}
+
+// Location describes the site at which a device is installed
+type Location struct {
+	Name       string `json:"name"`
+	Address    string `json:"address"`
+	City       string `json:"city"`
+	State      string `json:"state"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+}
+
+// IsDoorOpener reports whether the device is a garage door or gate
+// opener that can be controlled with SetDoorState
+func (d *Device) IsDoorOpener() bool {
+	switch d.Family {
+	case "garagedoor", "gate":
+		return true
+	case "":
+		// Older payloads lack a device family
+		return d.DoorState != ""
+	default:
+		return false
+	}
+}
+
+// Actions returns the actions the device supports, based on its type.
+// ActionStop isn't included, since it depends on the opener model.  For
+// lamp modules they are the states accepted by SetLampState.
+func (d *Device) Actions() []string {
+	switch {
+	case d.IsDoorOpener():
+		return []string{ActionOpen, ActionClose}
+	case d.IsLock():
+		return []string{ActionLock, ActionUnlock}
+	case d.IsLamp():
+		return []string{StateOn, StateOff}
+	case d.Family == "gateway":
+		return []string{ActionReboot}
+	default:
+		return nil
+	}
+}
+
+// InMotion reports whether the door is currently opening or closing,
+// for instance as the result of a previous command, or is about to
+// with a command pending.  Issuing a new command to a door in motion
+// can leave it in an unexpected state; see Session.RefuseInMotion.
+func (d *Device) InMotion() bool {
+	return d.CommandPending || d.DoorState == StateOpening || d.DoorState == StateClosing
+}
+
+// deviceJSON is the representation of a device returned by the
+// devices endpoints.  The state is decoded separately so that a change
+// in its shape doesn't prevent the device from being listed.
+type deviceJSON struct {
+	SerialNumber string          `json:"serial_number"`
+	DeviceType   string          `json:"device_type"`
+	DeviceFamily string          `json:"device_family"`
+	DeviceModel  jsonString      `json:"device_model"`
+	Hardware     jsonString      `json:"hardware_version"`
+	Name         string          `json:"name"`
+	Location     json.RawMessage `json:"location"`
+	State        json.RawMessage `json:"state"`
+	Attributes   json.RawMessage `json:"attributes"`
+}
+
+type locationJSON struct {
+	Name       jsonString `json:"name"`
+	Address    jsonString `json:"address"`
+	City       jsonString `json:"city"`
+	State      jsonString `json:"state"`
+	PostalCode jsonString `json:"postal_code"`
+	Country    jsonString `json:"country"`
+}
+
+// location returns the device's location.  Few accounts have one, and
+// its shape isn't settled, so anything other than an object of the
+// expected fields is ignored, except that a bare string is taken as the
+// location's name.
+func (dj *deviceJSON) location() Location {
+	var name string
+	if json.Unmarshal(dj.Location, &name) == nil {
+		return Location{Name: name}
+	}
+
+	var lj locationJSON
+	if json.Unmarshal(dj.Location, &lj) != nil {
+		return Location{}
+	}
+
+	return Location{
+		Name:       string(lj.Name),
+		Address:    string(lj.Address),
+		City:       string(lj.City),
+		State:      string(lj.State),
+		PostalCode: string(lj.PostalCode),
+		Country:    string(lj.Country),
+	}
+}
+
+type deviceStateJSON struct {
+	LockState  jsonString `json:"lock_state"`
+	LampState  jsonString `json:"lamp_state"`
+	Pending    jsonBool   `json:"command_pending"`
+	Online     jsonBool   `json:"online"`
+	LowBattery jsonBool   `json:"dps_low_battery_mode"`
+	LastUpdate jsonString `json:"last_update"`
+	Trigger    jsonString `json:"last_change_trigger"`
+}
+
+// doorStateFields are the fields, in priority order, in which MyQ
+// firmware versions have reported a device's door state
+var doorStateFields = [][]string{
+	{"state", "door_state"},
+	{"state", "status"},
+	{"state", "attributes", "door_state"},
+	{"attributes", "door_state"},
+}
+
+// doorState returns the door state from the first of doorStateFields
+// present in the device
+func (dj *deviceJSON) doorState() string {
+	roots := map[string]json.RawMessage{
+		"state":      dj.State,
+		"attributes": dj.Attributes,
+	}
+
+	for _, field := range doorStateFields {
+		if v, ok := lookupJSON(roots[field[0]], field[1:]); ok {
+			if Debug {
+				fmt.Fprintf(os.Stderr, "Door state of device %s read from %s\n", dj.SerialNumber, strings.Join(field, "."))
+			}
+			return v
+		}
+	}
+
+	return ""
+}
+
+// lookupJSON returns the non-empty string at the provided path of
+// object keys in raw
+func lookupJSON(raw json.RawMessage, path []string) (string, bool) {
+	for _, key := range path {
+		var obj map[string]json.RawMessage
+		if len(raw) == 0 || json.Unmarshal(raw, &obj) != nil {
+			return "", false
+		}
+		raw = obj[key]
+	}
+
+	var v jsonString
+	if len(raw) == 0 || json.Unmarshal(raw, &v) != nil || v == "" {
+		return "", false
+	}
+	return string(v), true
+}
+
+func (dj *deviceJSON) device(acct *Account) Device {
+	d := Device{
+		Account:      acct,
+		SerialNumber: dj.SerialNumber,
+		Type:         dj.DeviceType,
+		Family:       dj.DeviceFamily,
+		Model:        string(dj.DeviceModel),
+		Name:         dj.Name,
+
+		HardwareVersion: string(dj.Hardware),
+		Location:        dj.location(),
+	}
+
+	var state deviceStateJSON
+	if len(dj.State) > 0 {
+		if err := json.Unmarshal(dj.State, &state); err != nil {
+			d.DoorState = StateUnknown
+			d.StateError = fmt.Errorf("parsing state of device %s: %w", dj.SerialNumber, err)
+			return d
+		}
+	}
+
+	d.DoorState = normalizeDoorState(dj.doorState())
+	d.LockState = strings.ToLower(string(state.LockState))
+	d.LampState = strings.ToLower(string(state.LampState))
+	d.CommandPending = bool(state.Pending)
+	d.Online = bool(state.Online)
+	d.LowBattery = bool(state.LowBattery)
+	d.LastChangeTrigger = strings.ToLower(string(state.Trigger))
+
+	// MyQ has been known to send an empty string here, so parse
+	// leniently rather than failing the whole response.
+	if t, err := time.Parse(time.RFC3339Nano, string(state.LastUpdate)); err == nil {
+		d.LastUpdate = t
+	}
+
+	return d
+}
+
+// StatusError is implemented by errors returned when MyQ responds to a
+// request with an HTTP error status.  Use errors.As to obtain it:
+//
+//	var se myq.StatusError
+//	if errors.As(err, &se) && se.StatusCode() == http.StatusTooManyRequests {
+//		...
+//	}
+type StatusError interface {
+	error
+
+	// StatusCode returns the HTTP status code of the response
+	StatusCode() int
 }
 
+var _ StatusError = (*errorResponse)(nil)
+
 type errorResponse struct {
-	StatusCode int `json:"-"`
+	status int
 
 	Message     string
 	Description string
 }
 
+func (e *errorResponse) StatusCode() int {
+	return e.status
+}
+
 func (e *errorResponse) Error() string {
 	if e.Description != "" {
 		return e.Message + ": " + e.Description
@@ -80,9 +700,56 @@ func (e *errorResponse) Error() string {
 	return e.Message
 }
 
+func (e *errorResponse) Is(target error) bool {
+	switch target {
+	case ErrForbidden:
+		return e.status == http.StatusForbidden
+	case ErrSubscriptionRequired:
+		return e.status == http.StatusPaymentRequired ||
+			strings.Contains(strings.ToLower(e.Message+" "+e.Description), "subscription")
+	default:
+		return false
+	}
+}
+
 func isStatus(err error, code int) bool {
-	e, ok := err.(*errorResponse)
-	return ok && e.StatusCode == code
+	var e StatusError
+	return errors.As(err, &e) && e.StatusCode() == code
+}
+
+// RequestError is returned when a request to MyQ fails.  It records
+// how many attempts were made, including any made after renewing the
+// token or a failed connection, and how long they took in total.
+type RequestError struct {
+	Err      error
+	Attempts int
+	Elapsed  time.Duration
+}
+
+func (e *RequestError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("%v (after %d attempts in %v)", e.Err, e.Attempts, e.Elapsed.Round(time.Millisecond))
+	}
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// TransportError is returned when MyQ couldn't be reached, or the
+// connection failed before a response was received, as opposed to MyQ
+// responding with an error
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
 }
 
 func drain(rc io.ReadCloser) {
@@ -90,7 +757,47 @@ func drain(rc io.ReadCloser) {
 	rc.Close()
 }
 
+// limitedBody is a response body that fails with ErrResponseTooLarge
+// once more than n bytes have been read from it
+type limitedBody struct {
+	r io.Reader
+	n int64
+	c io.Closer
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		return n, ErrResponseTooLarge
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.c.Close()
+}
+
+// doRequest issues req, retrying once if it couldn't be sent
 func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := doRequestOnce(client, req)
+	if isRetryable(req, err) {
+		resp, err = doRequestOnce(client, req)
+	}
+	return resp, err
+}
+
+// isRetryable reports whether req, which failed with err, should be
+// sent again.  Connections to MyQ are reset often enough that it's
+// worth retrying, but only for requests that can't move a door.
+func isRetryable(req *http.Request, err error) bool {
+	var te *TransportError
+	return errors.As(err, &te) && isIdempotent(req) && req.Context().Err() == nil &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// doRequestOnce issues req
+func doRequestOnce(client *http.Client, req *http.Request) (*http.Response, error) {
 	if Debug {
 		d, _ := httputil.DumpRequestOut(req, true)
 		fmt.Fprintln(os.Stderr, string(d))
@@ -99,7 +806,20 @@ func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		if Recorder != nil {
+			Recorder.record(req, nil, err)
+		}
+		return nil, &TransportError{Err: err}
+	}
+
+	resp.Body = &limitedBody{
+		r: io.LimitReader(resp.Body, MaxResponseSize+1),
+		n: MaxResponseSize,
+		c: resp.Body,
+	}
+
+	if Recorder != nil {
+		Recorder.record(req, resp, nil)
 	}
 
 	if Debug {
@@ -111,95 +831,673 @@ func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
-func (s *Session) apiRequest(req *http.Request, target interface{}) error {
+// isHTML reports whether resp, whose body is read from body, is an
+// HTML page
+func isHTML(resp *http.Response, body *bufio.Reader) bool {
+	if strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return true
+	}
+
+	for i := 1; i <= 512; i++ {
+		b, err := body.Peek(i)
+		if err != nil || len(b) < i {
+			return false
+		}
+		switch b[i-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b[i-1] == '<'
+	}
+	return false
+}
+
+var (
+	htmlTagRE = regexp.MustCompile(`<[^>]*>`)
+	emailRE   = regexp.MustCompile(`[^\s@<>"']+@[^\s@<>"']+`)
+)
+
+// htmlSnippet returns the start of the text of the HTML page read from
+// r, with any email addresses redacted, for error messages
+func htmlSnippet(r io.Reader) string {
+	b, _ := ioutil.ReadAll(io.LimitReader(r, 4096))
+
+	text := htmlTagRE.ReplaceAllString(string(b), " ")
+	text = emailRE.ReplaceAllString(text, "REDACTED")
+	text = strings.Join(strings.Fields(text), " ")
+
+	if r := []rune(text); len(r) > 100 {
+		text = string(r[:100]) + "..."
+	}
+	return strconv.Quote(text)
+}
+
+// isIdempotent reports whether req can safely be sent twice
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD":
+		return req.Body == nil
+	default:
+		return false
+	}
+}
+
+// apiRequest issues req and decodes a successful JSON response into
+// target.  The response is returned, with its body already consumed,
+// so that callers can inspect the status code and headers.
+func (s *Session) apiRequest(req *http.Request, target interface{}) (*http.Response, error) {
+	// Renew a token about to expire rather than have the request
+	// rejected and retried.  Renewal has its own timeout, so it
+	// doesn't count against the request's.
+	s.mu.Lock()
+	token := s.token
+	expiring := token != "" && !s.tokenValid()
+	s.mu.Unlock()
+	if expiring {
+		s.logf("myq: token expiring, renewing: method=%s url=%s", req.Method, req.URL)
+		if err := s.renewToken(req.Context(), token); err != nil {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		token = s.token
+		s.mu.Unlock()
+	}
+
+	timeout := timeoutOr(s.WriteTimeout, timeoutOr(s.Timeout, defaultWriteTimeout))
+	if isIdempotent(req) {
+		timeout = timeoutOr(s.ReadTimeout, timeoutOr(s.Timeout, defaultReadTimeout))
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
 	if req.Body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
-	if s.token != "" {
-		req.Header.Set("Authorization", "Bearer "+s.token)
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	resp, err := doRequest(http.DefaultClient, req)
+	// apiResponseWithRetry retries failed connections, so that the
+	// retry counts as an attempt
+	resp, err := doRequestOnce(s.httpClient(), req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer drain(resp.Body)
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		return json.NewDecoder(resp.Body).Decode(target)
+		body := bufio.NewReader(resp.Body)
+		if isHTML(resp, body) {
+			return resp, fmt.Errorf("%w: %s", ErrHTMLResponse, htmlSnippet(body))
+		}
+
+		// MyQ occasionally responds with no body at all, which is
+		// treated like a 204 and leaves target untouched
+		err := json.NewDecoder(body).Decode(target)
+		if err == io.EOF {
+			err = nil
+		}
+		return resp, err
 
 	case http.StatusNoContent, http.StatusAccepted:
-		return nil
+		return resp, nil
 
 	case http.StatusUnauthorized:
-		return ErrNotLoggedIn
+		return resp, ErrNotLoggedIn
 
 	default:
 		var errResp errorResponse
 		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
 			errResp.Message = fmt.Sprintf("received HTTP status code %d", resp.StatusCode)
 		}
-		errResp.StatusCode = resp.StatusCode
-		return &errResp
+		errResp.status = resp.StatusCode
+		return resp, &errResp
 	}
 }
 
 func (s *Session) apiRequestWithRetry(req *http.Request, target interface{}) error {
-	if err := s.apiRequest(req, target); err == ErrNotLoggedIn {
-		if err := s.Login(); err != nil {
-			return err
-		}
+	_, err := s.apiResponseWithRetry(req, target)
+	return err
+}
 
-		return s.apiRequest(req, target)
-	} else {
-		return err
+// apiResponseWithRetry is like apiRequestWithRetry, but also returns
+// the response
+func (s *Session) apiResponseWithRetry(req *http.Request, target interface{}) (*http.Response, error) {
+	if s.ReadOnly && !isIdempotent(req) {
+		return nil, ErrReadOnly
 	}
-}
 
-// Login establishes an authenticated Session with the MyQ service
-func (s *Session) Login() error {
-	o, err := newOAuth()
-	if err != nil {
-		return err
+	var (
+		start    = time.Now()
+		attempts int
+		relogged bool
+		resent   bool
+		resp     *http.Response
+		err      error
+	)
+
+	for {
+		attempts++
+		resp, err = s.apiRequest(req, target)
+
+		switch {
+		case isRetryable(req, err) && !resent:
+			resent = true
+			s.logf("myq: connection failed, retrying: method=%s url=%s attempt=%d err=%q", req.Method, req.URL, attempts, err)
+			continue
+
+		case err == ErrNotLoggedIn && !relogged:
+			relogged = true
+			// Renewing the token with the refresh token is much
+			// quicker than logging in, and not at the mercy of
+			// changes to the login page
+			s.logf("myq: token rejected, renewing: method=%s url=%s attempt=%d", req.Method, req.URL, attempts)
+			if err = s.renewToken(req.Context(), requestToken(req)); err == nil {
+				err = resetBody(req)
+			}
+			if err == nil {
+				continue
+			}
+
+		case isStatus(err, http.StatusTooManyRequests) && isIdempotent(req) && attempts <= maxRateLimitRetries:
+			delay := retryDelay(resp, attempts)
+			s.logf("myq: rate limited, retrying: method=%s url=%s status=%d attempt=%d sleep=%v", req.Method, req.URL, resp.StatusCode, attempts, delay)
+			if err = sleep(req.Context(), delay); err == nil {
+				continue
+			}
+		}
+
+		break
 	}
 
-	u, err := o.authorize()
 	if err != nil {
-		return err
+		return resp, &RequestError{
+			Err:      err,
+			Attempts: attempts,
+			Elapsed:  time.Since(start),
+		}
 	}
 
-	u, err = o.login(u, s.Username, s.Password)
-	if err != nil {
-		return err
+	return resp, nil
+}
+
+// maxRateLimitRetries is the number of times a rate limited request is
+// retried
+const maxRateLimitRetries = 3
+
+// retryDelay returns how long to wait before retrying a rate limited
+// request, honoring the Retry-After header if MyQ sent one
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
 	}
+	return time.Second << uint(attempt-1)
+}
 
-	u, err = o.callback(u)
-	if err != nil {
-		return err
+// sleep pauses for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
 	}
+}
 
-	token, err := o.token(u)
-	if err != nil {
-		return err
+func (s *Session) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
 	}
+}
 
-	s.token = token
-	return nil
+// requestToken returns the token apiRequest sent with req
+func requestToken(req *http.Request) string {
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
 }
 
-func (s *Session) fillAccounts() error {
-	if len(s.accounts) > 0 {
+// resetBody prepares req's body to be sent again
+func resetBody(req *http.Request) error {
+	if req.GetBody == nil {
 		return nil
 	}
 
-	req, err := http.NewRequest("GET", accountsEndpoint, nil)
+	body, err := req.GetBody()
 	if err != nil {
 		return err
 	}
+	req.Body = body
+	return nil
+}
 
-	var jsonResponse struct {
-		Accounts []*Account `json:"accounts"`
+// Do issues an authenticated request to the MyQ API, for calling
+// endpoints this package doesn't otherwise support.  path is either a
+// full URL or a path on the MyQ devices host,
+// https://devices.myq-cloud.com.  If body is non-nil it is encoded as
+// the JSON request body, and a JSON response is decoded into target.
+// As with the rest of the API, the Session renews its token if it has
+// expired.
+func (s *Session) Do(ctx context.Context, method, path string, body, target interface{}) error {
+	_, err := s.DoResponse(ctx, method, path, body, target)
+	return err
+}
+
+// DoResponse is like Do, but also returns the final response, for
+// instance to inspect rate limiting or caching headers.  Its body has
+// already been consumed into target and closed.  The response is
+// returned with HTTP errors from MyQ too, but it is nil if no response
+// was received.
+func (s *Session) DoResponse(ctx context.Context, method, path string, body, target interface{}) (*http.Response, error) {
+	base, err := url.Parse(devicesHost)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := base.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+
+	if target == nil {
+		target = &struct{}{}
+	}
+
+	return s.apiResponseWithRetry(req, target)
+}
+
+// Login establishes an authenticated Session with the MyQ service
+func (s *Session) Login() error {
+	return s.loginContext(context.Background())
+}
+
+// loginContext is Login, giving up when ctx is done as well as after
+// LoginTimeout
+func (s *Session) loginContext(ctx context.Context) error {
+	if s.Username == "" || s.Password == "" {
+		return ErrMissingCredentials
+	}
+
+	redirectURIs := OAuthRedirectURIs
+	if len(redirectURIs) == 0 {
+		redirectURIs = []string{OAuthRedirectURI}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeoutOr(s.LoginTimeout, defaultLoginTimeout))
+	defer cancel()
+
+	var err error
+	for _, redirectURI := range redirectURIs {
+		if err = s.login(ctx, redirectURI); err != errNoAuthorizationCode {
+			break
+		}
+	}
+	return err
+}
+
+// LoginWithCode logs into MyQ using an authorization code from a login
+// completed elsewhere, such as in a browser on another device, and
+// verifier, the PKCE code verifier it was requested with.  Only the
+// exchange of the code for a token is done.
+//
+// To obtain a code, generate a random verifier of 43 to 128 letters,
+// digits, and "-._~" characters, and have the user log in at
+// OAuthAuthorizeEndpoint with these query parameters:
+//
+//	client_id=IOS_CGI_MYQ (OAuthClientID)
+//	redirect_uri=com.myqops://ios (OAuthRedirectURI)
+//	response_type=code
+//	scope=MyQ_Residential offline_access
+//	code_challenge=<unpadded base64url SHA-256 of the verifier>
+//	code_challenge_method=S256
+//
+// After login MyQ redirects to OAuthRedirectURI with the code in the
+// "code" query parameter.  Codes are short-lived and usable only once.
+func (s *Session) LoginWithCode(code, verifier string) error {
+	if code == "" || verifier == "" {
+		return errors.New("authorization code and verifier must both be provided")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutOr(s.LoginTimeout, defaultLoginTimeout))
+	defer cancel()
+
+	o, err := s.newOAuth(OAuthRedirectURI)
+	if err != nil {
+		return err
+	}
+	if err := o.usePKCE(PKCEMethodS256, verifier); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("code", code)
+	params.Set("scope", o.app.scope)
+
+	tr, err := o.token(ctx, &url.URL{RawQuery: params.Encode()})
+	if err != nil {
+		return err
+	}
+	s.loginStep(LoginStepToken)
+
+	s.mu.Lock()
+	s.oauth = o
+	s.mu.Unlock()
+
+	s.setToken(tr)
+	return nil
+}
+
+// newOAuth starts an OAuth flow for the Session's brand
+func (s *Session) newOAuth(redirectURI string) (*oauth, error) {
+	o, err := newOAuth(s.httpClient(), identityHost, redirectURI, s.CookieJar)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Brand != "" {
+		if err := o.useBrand(s.Brand); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (s *Session) login(ctx context.Context, redirectURI string) error {
+	o, err := s.newOAuth(redirectURI)
+	if err != nil {
+		return err
+	}
+
+	if s.Locale != "" {
+		o.locale = s.Locale
+	}
+
+	if s.PKCEMethod != "" || s.PKCEVerifier != "" {
+		if err := o.usePKCE(s.PKCEMethod, s.PKCEVerifier); err != nil {
+			return err
+		}
+	}
+
+	// The verification token from the login page can expire if
+	// submitting the credentials takes a while, so if it is rejected
+	// fetch a fresh one and try once more.
+	var u *url.URL
+	for attempt := 0; attempt < 2; attempt++ {
+		s.loginStep(LoginStepAuthorize)
+		u, err = o.authorize(ctx)
+		if err != nil {
+			return err
+		}
+		s.loginStep(LoginStepVerificationToken)
+
+		u, err = o.login(ctx, u, s.Username, s.Password)
+		if err != errVerificationTokenRejected {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.loginStep(LoginStepCredentials)
+
+	u, err = o.callback(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	tr, err := o.token(ctx, u)
+	if err != nil {
+		return err
+	}
+	s.loginStep(LoginStepToken)
+
+	s.mu.Lock()
+	s.oauth = o
+	s.mu.Unlock()
+
+	s.setToken(tr)
+	return nil
+}
+
+func (s *Session) setToken(tr *tokenResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = tr.AccessToken
+	s.scope = tr.Scope
+
+	s.tokenExpiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		s.tokenExpiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+
+	// A refresh response may not include a new refresh token, in
+	// which case the old one remains valid.
+	if tr.RefreshToken != "" {
+		s.refreshToken = tr.RefreshToken
+	}
+}
+
+// Refresh brings a long-lived Session up to date: it obtains a new
+// token, using the refresh token from the last login if possible and
+// logging in again otherwise, and re-fetches the user's accounts.  The
+// device list cached for CacheTTL is discarded, so the next Devices
+// call fetches it again.  Daemons can call it on a schedule to keep a
+// Session fresh.
+func (s *Session) Refresh(ctx context.Context) error {
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+
+	if err := s.renewToken(ctx, token); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.deviceAccounts = nil
+	s.devicesCachedAt = time.Time{}
+	s.mu.Unlock()
+
+	s.accounts = nil
+	return s.fillAccounts(ctx)
+}
+
+// renewal is a renewal of the token in progress
+type renewal struct {
+	done chan struct{}
+	err  error
+}
+
+// renewToken replaces stale, the token the caller found expired or
+// rejected.  Requests to several accounts run concurrently and tend to
+// find the token expired together, and MyQ refresh tokens can only be
+// used once, so only one renewal runs at a time: callers arriving while
+// one is in progress wait for it and share its result, and those
+// arriving after stale has already been replaced return immediately.
+func (s *Session) renewToken(ctx context.Context, stale string) error {
+	s.mu.Lock()
+	if s.token != stale && s.tokenValid() {
+		s.mu.Unlock()
+		return nil
+	}
+
+	if r := s.renewing; r != nil {
+		s.mu.Unlock()
+		select {
+		case <-r.done:
+			return r.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	r := &renewal{done: make(chan struct{})}
+	s.renewing = r
+	s.mu.Unlock()
+
+	r.err = s.renew(ctx)
+
+	s.mu.Lock()
+	s.renewing = nil
+	s.mu.Unlock()
+	close(r.done)
+
+	return r.err
+}
+
+// renew obtains a new token with the refresh token if possible,
+// falling back to logging in again
+func (s *Session) renew(ctx context.Context) error {
+	s.mu.Lock()
+	o, refreshToken := s.oauth, s.refreshToken
+	s.mu.Unlock()
+
+	// A token restored with LoadToken has no login flow behind it
+	if o == nil && refreshToken != "" {
+		var err error
+		if o, err = s.newOAuth(OAuthRedirectURI); err != nil {
+			return err
+		}
+	}
+
+	if o != nil && refreshToken != "" {
+		ctx, cancel := context.WithTimeout(ctx, timeoutOr(s.LoginTimeout, defaultLoginTimeout))
+		defer cancel()
+
+		if tr, err := o.refresh(ctx, refreshToken); err == nil {
+			s.setToken(tr)
+			return nil
+		}
+	}
+
+	return s.loginContext(ctx)
+}
+
+// Clone returns a new Session with the same credentials and
+// configuration as s, but without its token or cached accounts.  The
+// clone must log in separately.
+func (s *Session) Clone() *Session {
+	return &Session{
+		Username:       s.Username,
+		Password:       s.Password,
+		DebounceWindow: s.DebounceWindow,
+		ReadOnly:       s.ReadOnly,
+		RefuseInMotion: s.RefuseInMotion,
+		ReturnAccepted: s.ReturnAccepted,
+		PKCEMethod:     s.PKCEMethod,
+		PKCEVerifier:   s.PKCEVerifier,
+		CookieJar:      s.CookieJar,
+		Brand:          s.Brand,
+		Locale:         s.Locale,
+		OnLoginStep:    s.OnLoginStep,
+		MaxConcurrency: s.MaxConcurrency,
+		Logger:         s.Logger,
+		Timeout:        s.Timeout,
+		ReadTimeout:    s.ReadTimeout,
+		WriteTimeout:   s.WriteTimeout,
+		LoginTimeout:   s.LoginTimeout,
+		CacheTTL:       s.CacheTTL,
+		AccountsTTL:    s.AccountsTTL,
+		HTTPClient:     s.HTTPClient,
+		Dialer:         s.Dialer,
+		IPv4Only:       s.IPv4Only,
+
+		DeduplicateDevices: s.DeduplicateDevices,
+
+		AccountsAPIVersion: s.AccountsAPIVersion,
+		DevicesAPIVersion:  s.DevicesAPIVersion,
+	}
+}
+
+// GrantedScopes returns the OAuth scopes granted to the Session's
+// token, which may be fewer than the scopes requested at login.  It
+// returns nil if the Session is not logged in.
+func (s *Session) GrantedScopes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return strings.Fields(s.scope)
+}
+
+// TokenExpiry returns when the Session's token expires.  It returns
+// the zero time if the Session is not logged in or MyQ didn't say.
+func (s *Session) TokenExpiry() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokenExpiry
+}
+
+// TokenValid reports whether the Session has a token that is not about
+// to expire, so that callers can Refresh ahead of a latency-sensitive
+// action rather than during it
+func (s *Session) TokenValid() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokenValid()
+}
+
+// tokenValid is TokenValid, with s.mu held
+func (s *Session) tokenValid() bool {
+	if s.token == "" {
+		return false
+	}
+	return s.tokenExpiry.IsZero() || time.Now().Add(tokenExpirySkew).Before(s.tokenExpiry)
+}
+
+func (s *Session) loginStep(step string) {
+	if s.OnLoginStep != nil {
+		s.OnLoginStep(step)
+	}
+}
+
+// RefreshAccounts re-fetches the accounts the user has access to,
+// rather than waiting for AccountsTTL to expire
+func (s *Session) RefreshAccounts() error {
+	s.accounts = nil
+	return s.fillAccounts(context.Background())
+}
+
+// RefreshDevices re-fetches the list of devices, rather than waiting
+// for CacheTTL to expire
+func (s *Session) RefreshDevices() error {
+	_, err := s.fetchDevices(context.Background(), nil)
+	return err
+}
+
+func (s *Session) fillAccounts(ctx context.Context) error {
+	if len(s.accounts) > 0 && (s.AccountsTTL <= 0 || s.timeNow().Sub(s.accountsAt) < s.AccountsTTL) {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.versioned(AccountsEndpoint), nil)
+	if err != nil {
+		return err
+	}
+
+	var jsonResponse struct {
+		Accounts []*Account `json:"accounts"`
 	}
 
 	if err := s.apiRequestWithRetry(req, &jsonResponse); err != nil {
@@ -207,116 +1505,723 @@ func (s *Session) fillAccounts() error {
 	}
 
 	s.accounts = jsonResponse.Accounts
+	s.accountsAt = s.timeNow()
 	return nil
 }
 
 // Devices returns the list of MyQ devices
 func (s *Session) Devices() ([]Device, error) {
-	if err := s.fillAccounts(); err != nil {
+	return s.DevicesContext(context.Background())
+}
+
+// DevicesContext is like Devices, but gives up when ctx is done
+func (s *Session) DevicesContext(ctx context.Context) ([]Device, error) {
+	return s.devices(ctx, nil)
+}
+
+// DeviceMap returns the list of MyQ devices like Devices, but as a map
+// from serial number to device.  If a serial number appears in more
+// than one account, the device in the first is kept.
+func (s *Session) DeviceMap(ctx context.Context) (map[string]Device, error) {
+	devices, err := s.devices(ctx, nil)
+	if err != nil {
 		return nil, err
 	}
+	return deviceMap(devices), nil
+}
 
-	var devices []Device
-
-	for _, acct := range s.accounts {
-		devicesEndpoint := fmt.Sprintf(devicesEndpointFmt, acct.ID)
-		req, err := http.NewRequest("GET", devicesEndpoint, nil)
-		if err != nil {
-			return nil, err
+// deduplicate returns devices with only the first of any devices with
+// the same serial number
+func deduplicate(devices []Device) []Device {
+	seen := make(map[string]bool, len(devices))
+	unique := devices[:0:0]
+	for _, d := range devices {
+		if !seen[d.SerialNumber] {
+			seen[d.SerialNumber] = true
+			unique = append(unique, d)
 		}
+	}
+	return unique
+}
+
+func deviceMap(devices []Device) map[string]Device {
+	m := make(map[string]Device, len(devices))
+	for i := len(devices) - 1; i >= 0; i-- {
+		m[devices[i].SerialNumber] = devices[i]
+	}
+	return m
+}
+
+// Stats returns the number of accounts and devices found by the last
+// fetch of all devices, for instance as a quick check that they are
+// all being found.  Both are zero if there hasn't been one.
+func (s *Session) Stats() (accounts int, devices int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lastDevicesAt.IsZero() {
+		return 0, 0
+	}
+	return len(s.accounts), len(s.lastDevices)
+}
+
+// DevicesChangedSince returns the MyQ devices whose state was updated
+// after t, for instance to only process changes when polling.  Devices
+// that don't report when they were last updated are always included,
+// since it isn't known whether they changed.
+func (s *Session) DevicesChangedSince(ctx context.Context, t time.Time) ([]Device, error) {
+	devices, err := s.devices(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
 
-		type item struct {
-			SerialNumber string `json:"serial_number"`
-			DeviceType   string `json:"device_type"`
-			Name         string `json:"name"`
-			State        struct {
-				DoorState string `json:"door_state"`
-			} `json:"state"`
+	var changed []Device
+	for _, d := range devices {
+		if d.LastUpdate.IsZero() || d.LastUpdate.After(t) {
+			changed = append(changed, d)
 		}
+	}
+	return changed, nil
+}
+
+// DevicesWithParams returns the list of MyQ devices like Devices, but
+// passes the provided query parameters to the MyQ devices endpoint, for
+// instance to use server-side filtering
+func (s *Session) DevicesWithParams(params url.Values) ([]Device, error) {
+	return s.devices(context.Background(), params)
+}
+
+func (s *Session) devices(ctx context.Context, params url.Values) ([]Device, error) {
+	if len(params) == 0 && s.CacheTTL > 0 {
+		s.mu.Lock()
+		fresh := !s.devicesCachedAt.IsZero() && s.timeNow().Sub(s.devicesCachedAt) < s.CacheTTL
+		devices := append([]Device(nil), s.lastDevices...)
+		s.mu.Unlock()
 
-		var body struct {
-			Items []item `json:"items"`
+		if fresh {
+			return devices, nil
 		}
+	}
 
-		if err := s.apiRequestWithRetry(req, &body); err != nil {
-			return nil, err
+	return s.fetchDevices(ctx, params)
+}
+
+// fetchDevices fetches the devices in all of the user's accounts
+func (s *Session) fetchDevices(ctx context.Context, params url.Values) ([]Device, error) {
+	if err := s.fillAccounts(ctx); err != nil {
+		return nil, err
+	}
+
+	// Fetch each account's devices concurrently, but with a bounded
+	// number of requests in flight so as not to be rate limited.
+	var (
+		sem     = make(chan struct{}, s.maxConcurrency())
+		wg      sync.WaitGroup
+		results = make([][]Device, len(s.accounts))
+		errs    = make([]error, len(s.accounts))
+	)
+
+	for i, acct := range s.accounts {
+		wg.Add(1)
+		go func(i int, acct *Account) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = s.accountDevices(ctx, acct, params)
+		}(i, acct)
+	}
+	wg.Wait()
+
+	var devices []Device
+	for i := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
 		}
+		devices = append(devices, results[i]...)
+	}
+
+	s.rememberAccounts(devices)
+
+	if s.DeduplicateDevices {
+		devices = deduplicate(devices)
+	}
+
+	// Only a complete list is worth falling back to
+	if len(params) == 0 {
+		s.mu.Lock()
+		s.lastDevices = devices
+		s.lastDevicesAt = s.timeNow()
+		s.devicesCachedAt = s.lastDevicesAt
+		s.mu.Unlock()
+	}
+
+	return devices, nil
+}
+
+// DevicesOrLast returns the list of MyQ devices, like Devices, but if
+// they can't be fetched (including because ctx expires) it returns the
+// devices from the last successful fetch instead, along with when they
+// were fetched and stale set to true.  This suits dashboards that must
+// always render something.  An error is returned only if no fetch has
+// yet succeeded.
+func (s *Session) DevicesOrLast(ctx context.Context) (devices []Device, fetched time.Time, stale bool, err error) {
+	devices, err = s.devices(ctx, nil)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The devices may have come from the cache
+	if err == nil {
+		return devices, s.lastDevicesAt, false, nil
+	}
+
+	if s.lastDevicesAt.IsZero() {
+		return nil, time.Time{}, false, err
+	}
+
+	return append([]Device(nil), s.lastDevices...), s.lastDevicesAt, true, nil
+}
 
-		for i := range body.Items {
-			devices = append(devices, Device{
-				Account:      acct,
-				SerialNumber: body.Items[i].SerialNumber,
-				Type:         body.Items[i].DeviceType,
-				Name:         body.Items[i].Name,
-				DoorState:    body.Items[i].State.DoorState,
-			})
+func (s *Session) accountDevices(ctx context.Context, acct *Account, params url.Values) ([]Device, error) {
+	devicesEndpoint := s.versioned(fmt.Sprintf(DevicesEndpointFmt, acct.ID))
+	if len(params) > 0 {
+		devicesEndpoint += "?" + params.Encode()
+	}
+
+	var devices []Device
+	err := s.listAll(ctx, devicesEndpoint, func(item json.RawMessage) error {
+		var dj deviceJSON
+		if err := json.Unmarshal(item, &dj); err != nil {
+			return err
 		}
+
+		d := dj.device(acct)
+		s.observe(&d)
+		devices = append(devices, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return devices, nil
 }
 
+// versioned returns endpoint, one of the endpoints above, with the API
+// version replaced by the Session's AccountsAPIVersion or
+// DevicesAPIVersion if set
+func (s *Session) versioned(endpoint string) string {
+	def, v := defaultDevicesAPIVersion, s.DevicesAPIVersion
+	if strings.HasPrefix(endpoint, accountsHost+"/") {
+		def, v = defaultAccountsAPIVersion, s.AccountsAPIVersion
+	}
+
+	if v == "" || v == def {
+		return endpoint
+	}
+	return strings.Replace(endpoint, "/api/"+def+"/", "/api/"+v+"/", 1)
+}
+
+// timeNow returns the current time
+func (s *Session) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// timeoutOr returns d, or def if d is unset
+func timeoutOr(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+func (s *Session) maxConcurrency() int {
+	if s.MaxConcurrency > 0 {
+		return s.MaxConcurrency
+	}
+	return defaultMaxConcurrency
+}
+
 // DeviceState returns the device state (open, closed, etc.) for the
 // provided device serial number
 func (s *Session) DeviceState(serialNumber string) (string, error) {
-	if err := s.fillAccounts(); err != nil {
+	return s.DeviceStateContext(context.Background(), serialNumber)
+}
+
+// DeviceStateContext is like DeviceState, but gives up when ctx is done
+func (s *Session) DeviceStateContext(ctx context.Context, serialNumber string) (string, error) {
+	d, err := s.device(ctx, serialNumber)
+	if err != nil {
 		return "", err
 	}
 
-	for _, acct := range s.accounts {
-		deviceEndpoint := fmt.Sprintf(deviceEndpointFmt, acct.ID, serialNumber)
-		req, err := http.NewRequest("GET", deviceEndpoint, nil)
+	return d.DoorState, nil
+}
+
+// DoorState is the state of a door along with when it was reported,
+// returned by DeviceStateDetail
+type DoorState struct {
+	// State is the door state, such as StateClosed
+	State string
+
+	// LastUpdate is when the device last reported its state to
+	// MyQ.  It is the zero time if MyQ did not provide it.
+	LastUpdate time.Time
+
+	// Online is whether the device is connected to MyQ.  The state
+	// of an offline device may be out of date.
+	Online bool
+}
+
+// DeviceStateDetail returns the door state for the provided device
+// serial number, like DeviceState, along with when it was reported, so
+// that a reading from days ago isn't mistaken for a current one
+func (s *Session) DeviceStateDetail(serialNumber string) (DoorState, error) {
+	d, err := s.device(context.Background(), serialNumber)
+	if err != nil {
+		return DoorState{}, err
+	}
+
+	return DoorState{
+		State:      d.DoorState,
+		LastUpdate: d.LastUpdate,
+		Online:     d.Online,
+	}, nil
+}
+
+// DeviceStateFresh returns the device state for the provided device
+// serial number, like DeviceState, but only if the device has reported
+// its state within maxAge.  MyQ offers no way to request a new reading
+// from the device, so if the state is older than maxAge (or MyQ did not
+// report when it was last updated) ErrStaleState is returned along with
+// the stale state.
+func (s *Session) DeviceStateFresh(ctx context.Context, serialNumber string, maxAge time.Duration) (string, error) {
+	d, err := s.device(ctx, serialNumber)
+	if err != nil {
+		return "", err
+	}
+
+	if d.LastUpdate.IsZero() || time.Since(d.LastUpdate) > maxAge {
+		return d.DoorState, ErrStaleState
+	}
+
+	return d.DoorState, nil
+}
+
+// DeviceBySerial returns the current information for the device with
+// the provided serial number
+func (s *Session) DeviceBySerial(serialNumber string) (*Device, error) {
+	return s.device(context.Background(), serialNumber)
+}
+
+// SupportedActions returns the actions supported by the device with
+// the provided serial number, for instance to present only the
+// controls that apply to it
+func (s *Session) SupportedActions(serialNumber string) ([]string, error) {
+	d, err := s.device(context.Background(), serialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Actions(), nil
+}
+
+// DeviceByName returns the device with the provided name, compared
+// case-insensitively and ignoring surrounding whitespace, which the
+// MyQ app allows in names.  If no device has the name, the error
+// wraps ErrDeviceNotFound, and if more than one does, ErrAmbiguousName.
+func (s *Session) DeviceByName(name string) (*Device, error) {
+	devices, err := s.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []*Device
+	for i := range devices {
+		if strings.EqualFold(strings.TrimSpace(devices[i].Name), strings.TrimSpace(name)) {
+			matches = append(matches, &devices[i])
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("device named %q: %w", name, ErrDeviceNotFound)
+	case 1:
+		return matches[0], nil
+	default:
+		serials := make([]string, len(matches))
+		for i, d := range matches {
+			serials[i] = d.SerialNumber
+		}
+		return nil, fmt.Errorf("name %q %w: %s", name, ErrAmbiguousName, strings.Join(serials, ", "))
+	}
+}
+
+// DeviceExists reports whether any of the user's accounts contains a
+// device with the provided serial number.  If the Session has already
+// fetched the list of devices, it is answered from that list without
+// contacting MyQ, so a device added since then won't be found.
+func (s *Session) DeviceExists(serialNumber string) (bool, error) {
+	s.mu.Lock()
+	_, known := s.deviceAccounts[serialNumber]
+	fetched := !s.lastDevicesAt.IsZero()
+	s.mu.Unlock()
+
+	if known || fetched {
+		return known, nil
+	}
+
+	devices, err := s.DeviceMap(context.Background())
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := devices[serialNumber]
+	return ok, nil
+}
+
+// WaitForOnline polls the device with the provided serial number until
+// it reports that it is online, for instance after a power outage or a
+// gateway reboot, or until ctx is done.
+func (s *Session) WaitForOnline(ctx context.Context, serialNumber string) error {
+	return poll(ctx, 5*time.Second, time.Minute, func() (bool, error) {
+		d, err := s.device(ctx, serialNumber)
 		if err != nil {
-			return "", err
+			return false, err
 		}
+		return d.Online, nil
+	})
+}
 
-		var body struct {
-			SerialNumber string `json:"serial_number"`
-			DeviceType   string `json:"device_type"`
-			Name         string `json:"name"`
-			State        struct {
-				DoorState string `json:"door_state"`
-			} `json:"state"`
+// device fetches the current information for the device with the
+// provided serial number
+func (s *Session) device(ctx context.Context, serialNumber string) (*Device, error) {
+	if err := s.fillAccounts(ctx); err != nil {
+		return nil, err
+	}
+
+	for _, acct := range s.searchOrder(serialNumber) {
+		deviceEndpoint := s.versioned(fmt.Sprintf(deviceEndpointFmt, acct.ID, serialNumber))
+		req, err := http.NewRequestWithContext(ctx, "GET", deviceEndpoint, nil)
+		if err != nil {
+			return nil, err
 		}
 
+		var body deviceJSON
+
 		if err := s.apiRequestWithRetry(req, &body); err != nil {
 			if isStatus(err, http.StatusNotFound) {
 				continue
 			}
-			return "", err
+			return nil, err
 		}
 
-		return body.State.DoorState, nil
+		d := body.device(acct)
+		s.observe(&d)
+		s.rememberAccounts([]Device{d})
+		return &d, nil
 	}
 
-	return "", fmt.Errorf("device %s not found", serialNumber)
+	return nil, s.notFound(serialNumber)
 }
 
 // SetDoorState sets the target door state (open or closed) for the
-// provided device serial number
+// provided device serial number, or with ActionStop halts the door
 func (s *Session) SetDoorState(serialNumber string, action string) error {
-	if err := s.fillAccounts(); err != nil {
-		return err
+	_, err := s.SetDoorStateCommand(serialNumber, action)
+	return err
+}
+
+// SetDoorStateCommand is like SetDoorState, but also returns the ID of
+// the command MyQ created for the action, which can be passed to
+// CommandStatus.  The ID is empty if MyQ didn't return one, in which
+// case the door state must be polled instead.
+func (s *Session) SetDoorStateCommand(serialNumber string, action string) (string, error) {
+	// Reject bad input before spending any requests on it
+	switch action {
+	case ActionOpen, ActionClose, ActionStop:
+	default:
+		return "", fmt.Errorf("invalid door action %q", action)
+	}
+	if err := checkSerialNumber(serialNumber); err != nil {
+		return "", err
 	}
 
-	for _, acct := range s.accounts {
-		deviceActionsEndpoint := fmt.Sprintf(deviceActionsEndpointFmt, acct.ID, serialNumber, action)
-		req, err := http.NewRequest("PUT", deviceActionsEndpoint, nil)
+	if s.isDuplicateAction(serialNumber, action) {
+		return "", ErrDuplicateAction
+	}
+
+	ctx := context.Background()
+
+	// Send the action only to the account the device is known to be
+	// in.  Trying each account in turn could move the wrong door if
+	// two accounts have devices with the same serial number.
+	var acct *Account
+	if s.RefuseInMotion && action != ActionStop {
+		d, err := s.device(ctx, serialNumber)
 		if err != nil {
-			return err
+			return "", err
+		}
+		if d.CommandPending {
+			return "", fmt.Errorf("device %s has a command pending: %w", serialNumber, ErrInMotion)
 		}
+		if d.InMotion() {
+			return "", fmt.Errorf("device %s is %s: %w", serialNumber, d.DoorState, ErrInMotion)
+		}
+		acct = d.Account
+	} else {
+		var err error
+		if acct, err = s.deviceAccount(ctx, serialNumber); err != nil {
+			return "", err
+		}
+	}
 
-		var body struct{}
+	var body struct {
+		CommandID jsonString `json:"command_id"`
+	}
 
-		if err := s.apiRequestWithRetry(req, &body); err != nil {
-			if isStatus(err, http.StatusNotFound) {
-				continue
+	var resp *http.Response
+	for searched := false; ; searched = true {
+		deviceActionsEndpoint := s.versioned(fmt.Sprintf(deviceActionsEndpointFmt, acct.ID, serialNumber, action))
+		req, err := http.NewRequestWithContext(ctx, "PUT", deviceActionsEndpoint, nil)
+		if err != nil {
+			return "", err
+		}
+
+		resp, err = s.apiResponseWithRetry(req, &body)
+		if err == nil {
+			break
+		}
+
+		if !isStatus(err, http.StatusNotFound) {
+			// Openers that can't stop are refused with an error
+			// response explaining why
+			var se StatusError
+			if action == ActionStop && errors.As(err, &se) {
+				return "", fmt.Errorf("device %s could not stop: %w", serialNumber, err)
 			}
-			return err
+			return "", err
+		}
+		if searched {
+			return "", s.notFound(serialNumber)
 		}
 
-		return nil
+		// The device may have moved to another account since it
+		// was last seen, so search for it once more
+		s.logf("myq: device not in its known account, searching accounts: serial=%s account=%s", serialNumber, acct.ID)
+		s.forgetAccount(serialNumber, acct)
+
+		d, err := s.device(ctx, serialNumber)
+		if err != nil {
+			return "", err
+		}
+		acct = d.Account
+	}
+
+	s.recordAction(serialNumber, action)
+
+	if s.ReturnAccepted && resp.StatusCode != http.StatusOK {
+		return string(body.CommandID), ErrActionAccepted
+	}
+	return string(body.CommandID), nil
+}
+
+// deviceAccount returns the account containing the device with the
+// provided serial number, from the accounts of previously fetched
+// devices if possible
+func (s *Session) deviceAccount(ctx context.Context, serialNumber string) (*Account, error) {
+	s.mu.Lock()
+	acct := s.deviceAccounts[serialNumber]
+	s.mu.Unlock()
+
+	if acct != nil {
+		return acct, nil
+	}
+
+	s.logf("myq: account of device not known, searching accounts: serial=%s", serialNumber)
+
+	d, err := s.device(ctx, serialNumber)
+	if err != nil {
+		return nil, err
+	}
+	return d.Account, nil
+}
+
+// checkSerialNumber returns an error if serialNumber can't be the
+// serial number of a device, since it would otherwise be sent in the
+// path of a request
+func checkSerialNumber(serialNumber string) error {
+	if serialNumber == "" {
+		return errors.New("no device serial number given")
+	}
+	if strings.ContainsAny(serialNumber, "/?#% ") {
+		return fmt.Errorf("invalid device serial number %q", serialNumber)
+	}
+	return nil
+}
+
+// searchOrder returns the user's accounts in the order to search them
+// for the device with the provided serial number: the account it was
+// last seen in, if any, first.  Repeated lookups of a device then take
+// a single request however many accounts precede its own.
+func (s *Session) searchOrder(serialNumber string) []*Account {
+	s.mu.Lock()
+	known := s.deviceAccounts[serialNumber]
+	s.mu.Unlock()
+
+	if known == nil {
+		return s.accounts
+	}
+
+	// The account may have gone away since the device was seen
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, acct := range s.accounts {
+		if acct.ID == known.ID {
+			accounts = append([]*Account{acct}, accounts...)
+		} else {
+			accounts = append(accounts, acct)
+		}
+	}
+	return accounts
+}
+
+// rememberAccounts records the account of each of the devices.  If a
+// serial number appears in more than one account, the first is kept.
+func (s *Session) rememberAccounts(devices []Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.deviceAccounts == nil {
+		s.deviceAccounts = make(map[string]*Account)
+	}
+
+	for i := len(devices) - 1; i >= 0; i-- {
+		s.deviceAccounts[devices[i].SerialNumber] = devices[i].Account
+	}
+}
+
+// forgetAccount forgets that the device with the provided serial number
+// is in acct
+func (s *Session) forgetAccount(serialNumber string, acct *Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if known := s.deviceAccounts[serialNumber]; known != nil && known.ID == acct.ID {
+		delete(s.deviceAccounts, serialNumber)
+	}
+}
+
+// observe records the door state of d, noting when it changes
+func (s *Session) observe(d *Device) {
+	if d.DoorState == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.observed == nil {
+		s.observed = make(map[string]observedState)
+	}
+
+	prev, ok := s.observed[d.SerialNumber]
+	switch {
+	case !ok:
+		// The state may have changed long before we first saw it, so
+		// rely on MyQ for when.
+		s.observed[d.SerialNumber] = observedState{state: d.DoorState, changedAt: d.LastUpdate}
+	case prev.state != d.DoorState:
+		s.observed[d.SerialNumber] = observedState{state: d.DoorState, changedAt: time.Now()}
+	}
+}
+
+// StateAge returns how long the device with the provided serial number
+// has been in its current door state, as observed by this Session
+// across calls to Devices, DeviceState, and the like.  For a state that
+// hasn't changed since the Session first saw it, the device's
+// LastUpdate time is used.  It returns false if the Session hasn't
+// seen the device or doesn't know when its state last changed.
+func (s *Session) StateAge(serialNumber string) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.observed[serialNumber]
+	if !ok || o.changedAt.IsZero() {
+		return 0, false
+	}
+	return time.Since(o.changedAt), true
+}
+
+// OpenDoorByName opens the door with the provided name, as resolved by
+// DeviceByName
+func (s *Session) OpenDoorByName(name string) error {
+	return s.setDoorStateByName(name, ActionOpen)
+}
+
+// CloseDoorByName closes the door with the provided name, as resolved
+// by DeviceByName
+func (s *Session) CloseDoorByName(name string) error {
+	return s.setDoorStateByName(name, ActionClose)
+}
+
+func (s *Session) setDoorStateByName(name, action string) error {
+	d, err := s.DeviceByName(name)
+	if err != nil {
+		return err
+	}
+
+	return s.SetDoorState(d.SerialNumber, action)
+}
+
+func (s *Session) isDuplicateAction(serialNumber, action string) bool {
+	if s.DebounceWindow <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, ok := s.lastActions[serialNumber]
+	return ok && last.action == action && time.Since(last.at) < s.DebounceWindow
+}
+
+func (s *Session) recordAction(serialNumber, action string) {
+	if s.DebounceWindow <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lastActions == nil {
+		s.lastActions = make(map[string]lastAction)
+	}
+	s.lastActions[serialNumber] = lastAction{action: action, at: time.Now()}
+}
+
+// RebootGateway reboots the MyQ gateway (hub) with the provided serial
+// number, which can clear a stuck state without power cycling it.
+func (s *Session) RebootGateway(serialNumber string) error {
+	ctx := context.Background()
+
+	d, err := s.device(ctx, serialNumber)
+	if err != nil {
+		return err
+	}
+
+	if d.Family != "gateway" {
+		return fmt.Errorf("device %s is not a gateway", serialNumber)
+	}
+
+	endpoint := s.versioned(fmt.Sprintf(gatewayActionsEndpointFmt, d.Account.ID, serialNumber, ActionReboot))
+	req, err := http.NewRequestWithContext(ctx, "PUT", endpoint, nil)
+	if err != nil {
+		return err
 	}
 
-	return fmt.Errorf("device %s not found", serialNumber)
+	var body struct{}
+	return s.apiRequestWithRetry(req, &body)
 }
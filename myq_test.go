@@ -0,0 +1,964 @@
+package myq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTransport sends every request to srv, whichever MyQ host it is
+// for, leaving the original host in the request's Host header.  The
+// response is for the original request, so relative links on the
+// pages served resolve against the MyQ host.
+type testTransport struct {
+	srv *httptest.Server
+}
+
+func (t testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.srv.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	out := req.Clone(req.Context())
+	out.Host = req.URL.Host
+	out.URL.Scheme = u.Scheme
+	out.URL.Host = u.Host
+
+	resp, err := http.DefaultTransport.RoundTrip(out)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// testSession returns a Session logged in with the token "token" whose
+// requests are all served by h
+func testSession(t testing.TB, h http.Handler) (*Session, *httptest.Server) {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	s := &Session{
+		HTTPClient: &http.Client{Transport: testTransport{srv}},
+		token:      "token",
+	}
+	return s, srv
+}
+
+// fakeMyQ is an in-memory MyQ API serving accounts and their devices.
+// Devices are given as the JSON the devices endpoint returns for them.
+type fakeMyQ struct {
+	mu sync.Mutex
+
+	accounts []*Account
+	devices  map[string][]string
+
+	token        string
+	refreshToken string
+
+	// tokenDelay is how long the token endpoint takes to respond
+	tokenDelay time.Duration
+
+	requests      map[string]int
+	tokenRequests int
+}
+
+func newFakeMyQ() *fakeMyQ {
+	return &fakeMyQ{
+		devices:  map[string][]string{},
+		token:    "token",
+		requests: map[string]int{},
+	}
+}
+
+// addDevice adds a device, creating its account if need be
+func (f *fakeMyQ) addDevice(accountID, device string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.devices[accountID]; !ok {
+		f.accounts = append(f.accounts, &Account{ID: accountID, Name: "Account " + accountID})
+	}
+	f.devices[accountID] = append(f.devices[accountID], device)
+}
+
+// removeDevice removes the device with the provided serial number from
+// the account, returning its JSON
+func (f *fakeMyQ) removeDevice(accountID, serialNumber string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i := f.find(accountID, serialNumber)
+	d := f.devices[accountID][i]
+	f.devices[accountID] = append(f.devices[accountID][:i], f.devices[accountID][i+1:]...)
+	return d
+}
+
+// find returns the index of the device with the provided serial number
+// in the account, or -1.  f.mu must be held.
+func (f *fakeMyQ) find(accountID, serialNumber string) int {
+	for i, d := range f.devices[accountID] {
+		var dj deviceJSON
+		if json.Unmarshal([]byte(d), &dj) == nil && dj.SerialNumber == serialNumber {
+			return i
+		}
+	}
+	return -1
+}
+
+// count returns the number of requests made for the method and path
+func (f *fakeMyQ) count(method, path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests[method+" "+path]
+}
+
+// total returns the number of requests made to the API
+func (f *fakeMyQ) total() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, c := range f.requests {
+		n += c
+	}
+	return n
+}
+
+func (f *fakeMyQ) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == tokenPath {
+		f.serveToken(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests[r.Method+" "+r.URL.Path]++
+
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/api/v6.0/accounts":
+		json.NewEncoder(w).Encode(map[string]interface{}{"accounts": f.accounts})
+
+	case len(parts) == 5 && parts[2] == "Accounts" && parts[4] == "Devices":
+		devices, ok := f.devices[parts[3]]
+		if !ok {
+			http.Error(w, `{"message":"account not found"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"count":%d,"items":[%s]}`, len(devices), strings.Join(devices, ","))
+
+	case len(parts) == 6 && parts[2] == "Accounts" && parts[4] == "Devices":
+		if i := f.find(parts[3], parts[5]); i >= 0 {
+			w.Write([]byte(f.devices[parts[3]][i]))
+			return
+		}
+		http.Error(w, `{"message":"device not found"}`, http.StatusNotFound)
+
+	case len(parts) == 7 && parts[2] == "Accounts" && parts[4] == "lamps":
+		if r.Method != "PUT" {
+			http.Error(w, `{"message":"method not allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		if f.find(parts[3], parts[5]) < 0 {
+			http.Error(w, `{"message":"device not found"}`, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	case len(parts) == 7 && parts[2] == "Accounts" && parts[4] == "door_openers" && r.Method == "PUT":
+		if f.find(parts[3], parts[5]) < 0 {
+			http.Error(w, `{"message":"device not found"}`, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+	}
+}
+
+// serveToken exchanges refresh tokens, each of which can be used once
+func (f *fakeMyQ) serveToken(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(f.tokenDelay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tokenRequests++
+
+	r.ParseForm()
+	if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != f.refreshToken {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	f.token = fmt.Sprintf("token%d", f.tokenRequests)
+	f.refreshToken = fmt.Sprintf("refresh%d", f.tokenRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  f.token,
+		"refresh_token": f.refreshToken,
+		"expires_in":    1800,
+	})
+}
+
+// fakeDoor returns the JSON for a garage door opener
+func fakeDoor(serialNumber, name, state string) string {
+	return fmt.Sprintf(`{"serial_number":%q,"device_family":"garagedoor","name":%q,"state":{"door_state":%q,"online":true}}`,
+		serialNumber, name, state)
+}
+
+// Requests to several accounts at once that find the token expired
+// must renew it only once, since refresh tokens can only be used once
+func TestRenewTokenConcurrent(t *testing.T) {
+	f := newFakeMyQ()
+	f.token = "expired"
+	f.refreshToken = "refresh"
+	f.tokenDelay = 50 * time.Millisecond
+	for i := 1; i <= 4; i++ {
+		f.addDevice(fmt.Sprint(i), fakeDoor(fmt.Sprintf("CG%d", i), fmt.Sprintf("Door %d", i), StateClosed))
+	}
+
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	s.token = "expired"
+	s.tokenExpiry = time.Now().Add(-time.Minute)
+	s.refreshToken = "refresh"
+	s.accounts = f.accounts
+	s.accountsAt = time.Now()
+
+	devices, err := s.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 4 {
+		t.Errorf("got %d devices, want 4", len(devices))
+	}
+
+	if f.tokenRequests != 1 {
+		t.Errorf("got %d token requests, want 1", f.tokenRequests)
+	}
+	if !s.TokenValid() {
+		t.Error("token not valid after renewal")
+	}
+}
+
+// A token rejected by several requests at once is also renewed once
+func TestRenewTokenRejectedConcurrent(t *testing.T) {
+	f := newFakeMyQ()
+	f.token = "new"
+	f.refreshToken = "refresh"
+	f.tokenDelay = 50 * time.Millisecond
+	for i := 1; i <= 4; i++ {
+		f.addDevice(fmt.Sprint(i), fakeDoor(fmt.Sprintf("CG%d", i), fmt.Sprintf("Door %d", i), StateClosed))
+	}
+
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	s.refreshToken = "refresh"
+	s.accounts = f.accounts
+	s.accountsAt = time.Now()
+
+	if _, err := s.Devices(); err != nil {
+		t.Fatal(err)
+	}
+	if f.tokenRequests != 1 {
+		t.Errorf("got %d token requests, want 1", f.tokenRequests)
+	}
+}
+
+func TestDeviceLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		want     Location
+	}{
+		{"absent", ``, Location{}},
+		{"null", `,"location":null`, Location{}},
+		{"object", `,"location":{"name":"Cottage","city":"Bar Harbor","state":"ME","postal_code":"04609"}`,
+			Location{Name: "Cottage", City: "Bar Harbor", State: "ME", PostalCode: "04609"}},
+		{"numeric postal code", `,"location":{"name":"Home","postal_code":2134}`, Location{Name: "Home", PostalCode: "2134"}},
+		{"string", `,"location":"Cottage"`, Location{Name: "Cottage"}},
+		{"number", `,"location":42`, Location{}},
+		{"array", `,"location":["Cottage"]`, Location{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dj deviceJSON
+			if err := json.Unmarshal([]byte(`{"serial_number":"CG1"`+tt.location+`}`), &dj); err != nil {
+				t.Fatal(err)
+			}
+			if got := dj.device(nil).Location; got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// An unexpected location must not prevent the devices being listed
+func TestDevicesLocationString(t *testing.T) {
+	f := newFakeMyQ()
+	f.addDevice("1", `{"serial_number":"CG1","device_family":"garagedoor","name":"Garage","location":"Cottage","state":{"door_state":"open"}}`)
+
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	devices, err := s.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].DoorState != StateOpen || devices[0].Location.Name != "Cottage" {
+		t.Errorf("got devices %+v", devices)
+	}
+}
+
+func TestDeviceActions(t *testing.T) {
+	tests := []struct {
+		family string
+		want   []string
+	}{
+		{"garagedoor", []string{ActionOpen, ActionClose}},
+		{"gate", []string{ActionOpen, ActionClose}},
+		{"lamp", []string{StateOn, StateOff}},
+		{"gateway", []string{ActionReboot}},
+		{"camera", nil},
+	}
+
+	for _, tt := range tests {
+		d := Device{Family: tt.family}
+		if got := d.Actions(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got actions %v, want %v", tt.family, got, tt.want)
+		}
+	}
+}
+
+func TestSetLampState(t *testing.T) {
+	f := newFakeMyQ()
+	f.addDevice("1", `{"serial_number":"LM1","device_family":"lamp","name":"Porch","state":{"lamp_state":"off","online":true}}`)
+
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	d, err := s.DeviceBySerial("LM1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.LampState != StateOff {
+		t.Errorf("got lamp state %q, want %q", d.LampState, StateOff)
+	}
+
+	if err := s.SetLampState("LM1", StateOn); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.count("PUT", "/api/v5.2/Accounts/1/lamps/LM1/on"); got != 1 {
+		t.Errorf("got %d PUT requests to the lamps endpoint, want 1", got)
+	}
+
+	if err := s.SetLampState("LM1", "dim"); err == nil {
+		t.Error("expected an error for an invalid state")
+	}
+}
+
+// fakeAccounts returns a fake MyQ with four accounts, the device CG4 in
+// the last of them
+func fakeAccounts() *fakeMyQ {
+	f := newFakeMyQ()
+	for i := 1; i <= 4; i++ {
+		f.addDevice(fmt.Sprint(i), fakeDoor(fmt.Sprintf("CG%d", i), fmt.Sprintf("Door %d", i), StateClosed))
+	}
+	return f
+}
+
+// Once the device has been found, looking it up again takes a single
+// request rather than one per account preceding its own
+func TestDeviceStateRepeated(t *testing.T) {
+	f := fakeAccounts()
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	if _, err := s.DeviceState("CG4"); err != nil {
+		t.Fatal(err)
+	}
+	// The accounts, and then the device in each of them
+	if n := f.total(); n != 5 {
+		t.Errorf("got %d requests for the first lookup, want 5", n)
+	}
+
+	before := f.total()
+	state, err := s.DeviceState("CG4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != StateClosed {
+		t.Errorf("got state %q, want %q", state, StateClosed)
+	}
+	if n := f.total() - before; n != 1 {
+		t.Errorf("got %d requests for the repeated lookup, want 1", n)
+	}
+	if n := f.count("GET", "/api/v5.2/Accounts/1/Devices/CG4"); n != 1 {
+		t.Errorf("first account searched %d times, want 1", n)
+	}
+}
+
+func BenchmarkDeviceState(b *testing.B) {
+	f := fakeAccounts()
+	s, srv := testSession(b, f)
+	defer srv.Close()
+
+	if _, err := s.DeviceState("CG4"); err != nil {
+		b.Fatal(err)
+	}
+
+	before := f.total()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.DeviceState("CG4"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(f.total()-before)/float64(b.N), "requests/op")
+}
+
+// resetConnections returns a handler that resets the connection of the
+// first n requests, and otherwise responds with an empty JSON object,
+// counting the requests in hits
+func resetConnections(n int32, hits *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(hits, 1) > n {
+			w.Write([]byte(`{}`))
+			return
+		}
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		conn.Close()
+	}
+}
+
+// Cancelling the context ends a request in flight, rather than leaving
+// callers waiting for ReadTimeout
+func TestContextCancelsRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(ctx context.Context, s *Session) error
+	}{
+		{"DevicesContext", func(ctx context.Context, s *Session) error {
+			_, err := s.DevicesContext(ctx)
+			return err
+		}},
+		{"DeviceStateContext", func(ctx context.Context, s *Session) error {
+			_, err := s.DeviceStateContext(ctx, "CG1")
+			return err
+		}},
+		{"CommandStatusContext", func(ctx context.Context, s *Session) error {
+			_, err := s.CommandStatusContext(ctx, "CG1", "cmd")
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{}, 1)
+			s, srv := testSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+				<-r.Context().Done()
+			}))
+			defer srv.Close()
+
+			s.ReadTimeout = time.Hour
+			s.accounts = []*Account{{ID: "1"}}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errc := make(chan error)
+			go func() { errc <- tt.call(ctx, s) }()
+
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("request not sent")
+			}
+			cancel()
+
+			select {
+			case err := <-errc:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("got error %v, want context.Canceled", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("request not ended by cancellation")
+			}
+		})
+	}
+}
+
+func TestRetryConnectionReset(t *testing.T) {
+	var hits int32
+	s, srv := testSession(t, resetConnections(1, &hits))
+	defer srv.Close()
+
+	if err := s.Do(context.Background(), "GET", "/api/v5.2/Accounts", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+}
+
+func TestRetryConnectionResetAttempts(t *testing.T) {
+	var hits int32
+	s, srv := testSession(t, resetConnections(100, &hits))
+	defer srv.Close()
+
+	err := s.Do(context.Background(), "GET", "/api/v5.2/Accounts", nil, nil)
+
+	var re *RequestError
+	if !errors.As(err, &re) {
+		t.Fatalf("got error %v, want a *RequestError", err)
+	}
+	var te *TransportError
+	if !errors.As(err, &te) {
+		t.Errorf("got error %v, want a *TransportError", err)
+	}
+	if n := atomic.LoadInt32(&hits); re.Attempts != 2 || n != 2 {
+		t.Errorf("got %d attempts and %d requests, want 2", re.Attempts, n)
+	}
+}
+
+// A request that could move a door is never sent twice
+func TestNoRetryConnectionResetPUT(t *testing.T) {
+	var hits int32
+	s, srv := testSession(t, resetConnections(1, &hits))
+	defer srv.Close()
+
+	err := s.Do(context.Background(), "PUT", "/api/v5.2/Accounts/1/door_openers/CG1/open", nil, nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	var re *RequestError
+	if n := atomic.LoadInt32(&hits); !errors.As(err, &re) || re.Attempts != 1 || n != 1 {
+		t.Errorf("got error %v after %d requests, want 1 attempt", err, n)
+	}
+}
+
+// fakeClock is a clock advanced by the test
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestAccountsTTL(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want []int
+	}{
+		// Cached for the life of the Session by default
+		{0, []int{1, 1, 1}},
+		{time.Hour, []int{1, 1, 2}},
+	}
+
+	for _, tt := range tests {
+		f := newFakeMyQ()
+		f.addDevice("1", fakeDoor("CG1", "Garage", StateClosed))
+
+		s, srv := testSession(t, f)
+		defer srv.Close()
+
+		clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+		s.now = clock.now
+		s.AccountsTTL = tt.ttl
+
+		// Fetch the devices now, after half an hour, and after an
+		// hour and a half
+		for i, advance := range []time.Duration{0, 30 * time.Minute, time.Hour} {
+			clock.t = clock.t.Add(advance)
+			if _, err := s.Devices(); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.count("GET", "/api/v6.0/accounts"); got != tt.want[i] {
+				t.Errorf("TTL %v: got %d accounts requests after %d fetches, want %d", tt.ttl, got, i+1, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	f := newFakeMyQ()
+	f.addDevice("1", fakeDoor("CG1", "Garage", StateClosed))
+
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.now = clock.now
+	s.CacheTTL = time.Minute
+
+	for i, advance := range []time.Duration{0, 30 * time.Second, time.Minute} {
+		clock.t = clock.t.Add(advance)
+		if _, err := s.Devices(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := f.count("GET", "/api/v5.2/Accounts/1/Devices"), []int{1, 1, 2}[i]; got != want {
+			t.Errorf("got %d devices requests after %d fetches, want %d", got, i+1, want)
+		}
+	}
+}
+
+// Refresh must bring the Session fully up to date, rather than leaving
+// Devices returning the list cached before it
+func TestRefreshCacheTTL(t *testing.T) {
+	f := newFakeMyQ()
+	f.refreshToken = "refresh"
+	f.addDevice("1", fakeDoor("CG1", "Garage", StateClosed))
+
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	s.refreshToken = "refresh"
+	s.CacheTTL = time.Hour
+
+	if _, err := s.Devices(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Devices(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := f.count("GET", "/api/v5.2/Accounts/1/Devices"); got != 2 {
+		t.Errorf("got %d devices requests, want 2", got)
+	}
+
+	// The devices are still there to fall back to
+	if _, n := s.Stats(); n != 1 {
+		t.Errorf("got %d devices in Stats, want 1", n)
+	}
+}
+
+// statusHandler responds to every request with status and body,
+// counting the requests in hits
+func statusHandler(status int, body string, hits *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+// A 403 means the user isn't permitted, so it must be distinct from a
+// 401 and not prompt logging in again
+func TestAPIRequestForbidden(t *testing.T) {
+	var hits int32
+	s, srv := testSession(t, statusHandler(http.StatusForbidden, `{"message":"Forbidden","description":"not permitted to control this device"}`, &hits))
+	defer srv.Close()
+
+	err := s.Do(context.Background(), "PUT", "/api/v5.2/Accounts/1/door_openers/CG1/open", nil, nil)
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("got error %v, want ErrForbidden", err)
+	}
+	if errors.Is(err, ErrNotLoggedIn) {
+		t.Errorf("got error %v, which is also ErrNotLoggedIn", err)
+	}
+	if !isStatus(err, http.StatusForbidden) {
+		t.Errorf("got error %v, want status 403", err)
+	}
+	if !strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("got error %q, want MyQ's description", err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestAPIRequestUnauthorized(t *testing.T) {
+	var hits int32
+	s, srv := testSession(t, statusHandler(http.StatusUnauthorized, ``, &hits))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", AccountsEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.apiRequest(req, &struct{}{}); err != ErrNotLoggedIn {
+		t.Fatalf("got error %v, want ErrNotLoggedIn", err)
+	}
+}
+
+// With the same serial number in two accounts, an action is sent only
+// to the first account the device is known to be in, rather than to
+// each account in turn
+func TestSetDoorStateSharedSerial(t *testing.T) {
+	for _, listFirst := range []bool{true, false} {
+		f := newFakeMyQ()
+		f.addDevice("A", fakeDoor("CG2", "Other", StateClosed))
+		f.addDevice("B", fakeDoor("CG1", "Garage", StateClosed))
+		f.addDevice("C", fakeDoor("CG1", "Neighbor's Garage", StateClosed))
+
+		s, srv := testSession(t, f)
+		defer srv.Close()
+
+		if listFirst {
+			if _, err := s.Devices(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.SetDoorState("CG1", ActionOpen); err != nil {
+			t.Fatal(err)
+		}
+
+		for acct, want := range map[string]int{"A": 0, "B": 1, "C": 0} {
+			if got := f.count("PUT", "/api/v5.2/Accounts/"+acct+"/door_openers/CG1/open"); got != want {
+				t.Errorf("listed first %v: got %d actions sent to account %s, want %d", listFirst, got, acct, want)
+			}
+		}
+
+		// The action goes to account B from then on
+		if err := s.SetDoorState("CG1", ActionClose); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.count("PUT", "/api/v5.2/Accounts/B/door_openers/CG1/close"); got != 1 {
+			t.Errorf("listed first %v: got %d close actions sent to account B, want 1", listFirst, got)
+		}
+	}
+}
+
+// A device that has moved to another account since it was last seen is
+// found there, rather than the stale account failing every action
+func TestSetDoorStateMovedDevice(t *testing.T) {
+	f := newFakeMyQ()
+	f.addDevice("1", fakeDoor("CG1", "Garage", StateClosed))
+	f.addDevice("2", fakeDoor("CG2", "Shed", StateClosed))
+
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	if err := s.SetDoorState("CG1", ActionOpen); err != nil {
+		t.Fatal(err)
+	}
+
+	f.addDevice("2", f.removeDevice("1", "CG1"))
+
+	if err := s.SetDoorState("CG1", ActionClose); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.count("PUT", "/api/v5.2/Accounts/2/door_openers/CG1/close"); got != 1 {
+		t.Errorf("got %d actions sent to the new account, want 1", got)
+	}
+
+	// The new account is remembered
+	before := f.total()
+	if err := s.SetDoorState("CG1", ActionOpen); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.total() - before; got != 1 {
+		t.Errorf("got %d requests after the device was found again, want 1", got)
+	}
+
+	// A device that is gone altogether is reported as not found
+	f.removeDevice("2", "CG1")
+
+	if err := s.SetDoorState("CG1", ActionClose); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("got error %v, want ErrDeviceNotFound", err)
+	}
+}
+
+// MyQ occasionally responds 200 with no body, which is treated like a
+// 204 rather than failing to decode
+func TestAPIRequestEmpty200(t *testing.T) {
+	for _, body := range []string{"", "\r\n"} {
+		var hits int32
+		s, srv := testSession(t, statusHandler(http.StatusOK, body, &hits))
+
+		target := struct{ Status string }{Status: "untouched"}
+		req, err := http.NewRequest("GET", AccountsEndpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := s.apiRequest(req, &target)
+		if err != nil {
+			t.Errorf("body %q: got error %v", body, err)
+		} else if resp.StatusCode != http.StatusOK {
+			t.Errorf("body %q: got status %d", body, resp.StatusCode)
+		}
+		if target.Status != "untouched" {
+			t.Errorf("body %q: target changed to %+v", body, target)
+		}
+
+		srv.Close()
+	}
+}
+
+// A body that isn't empty must still be valid JSON
+func TestAPIRequestTruncated200(t *testing.T) {
+	var hits int32
+	s, srv := testSession(t, statusHandler(http.StatusOK, `{"accounts":[`, &hits))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", AccountsEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.apiRequest(req, &struct{}{}); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// fakeFixture returns a fake MyQ serving the devices in the named
+// devices endpoint response in testdata, in account 1
+func fakeFixture(t *testing.T, name string) *fakeMyQ {
+	t.Helper()
+
+	var page struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(readFixture(t, name), &page); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFakeMyQ()
+	for _, item := range page.Items {
+		f.addDevice("1", string(item))
+	}
+	return f
+}
+
+// DeviceByName matches the name shown in the MyQ app, which is the
+// top-level name rather than the original names left in the attributes
+// and state of a renamed device
+func TestDeviceByNameRenamed(t *testing.T) {
+	f := fakeFixture(t, "devices_renamed.json")
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{"Workshop", "CG0800000001", nil},
+		{"workshop", "CG0800000001", nil},
+		{"  Workshop\t", "CG0800000001", nil},
+		{"Garage Door Opener", "", ErrDeviceNotFound},
+
+		// Padded in the app
+		{"Left Garage", "CG0800000002", nil},
+		{"left garage", "CG0800000002", nil},
+		{"Left  Garage", "", ErrDeviceNotFound},
+
+		{"Barn", "", ErrAmbiguousName},
+	}
+
+	for _, tt := range tests {
+		d, err := s.DeviceByName(tt.name)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%q: got error %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr == nil && d.SerialNumber != tt.want {
+			t.Errorf("%q: got device %s, want %s", tt.name, d.SerialNumber, tt.want)
+		}
+	}
+}
+
+func TestRefuseInMotion(t *testing.T) {
+	tests := []struct {
+		refuse  bool
+		state   string
+		pending bool
+		action  string
+		wantErr error
+	}{
+		{true, StateOpening, false, ActionClose, ErrInMotion},
+		{true, StateClosing, false, ActionOpen, ErrInMotion},
+		{true, StateOpening, false, ActionStop, nil},
+		{true, StateClosed, false, ActionOpen, nil},
+		{true, StateOpen, false, ActionClose, nil},
+		{false, StateOpening, false, ActionClose, nil},
+
+		// Accepted, but not yet moving
+		{true, StateOpen, true, ActionOpen, ErrInMotion},
+		{true, StateOpen, true, ActionStop, nil},
+		{false, StateOpen, true, ActionClose, nil},
+	}
+
+	for _, tt := range tests {
+		f := newFakeMyQ()
+		f.addDevice("1", fmt.Sprintf(`{"serial_number":"CG1","device_family":"garagedoor","name":"Garage","state":{"door_state":%q,"command_pending":%v,"online":true}}`,
+			tt.state, tt.pending))
+
+		s, srv := testSession(t, f)
+		s.RefuseInMotion = tt.refuse
+
+		err := s.SetDoorState("CG1", tt.action)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s door, pending %v, %s with RefuseInMotion %v: got error %v, want %v", tt.state, tt.pending, tt.action, tt.refuse, err, tt.wantErr)
+		}
+
+		want := 1
+		if tt.wantErr != nil {
+			want = 0
+		}
+		if got := f.count("PUT", "/api/v5.2/Accounts/1/door_openers/CG1/"+tt.action); got != want {
+			t.Errorf("%s door, pending %v, %s with RefuseInMotion %v: got %d actions sent, want %d", tt.state, tt.pending, tt.action, tt.refuse, got, want)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestRefuseInMotionByName(t *testing.T) {
+	f := newFakeMyQ()
+	f.addDevice("1", fakeDoor("CG1", "Garage", StateOpening))
+
+	s, srv := testSession(t, f)
+	defer srv.Close()
+	s.RefuseInMotion = true
+
+	if err := s.CloseDoorByName("Garage"); !errors.Is(err, ErrInMotion) {
+		t.Errorf("got error %v, want ErrInMotion", err)
+	}
+	if got := f.count("PUT", "/api/v5.2/Accounts/1/door_openers/CG1/close"); got != 0 {
+		t.Errorf("got %d actions sent, want none", got)
+	}
+}
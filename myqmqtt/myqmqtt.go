@@ -0,0 +1,172 @@
+// Package myqmqtt bridges MyQ devices to MQTT, publishing their state
+// to per-device topics and optionally accepting commands, as Home
+// Assistant and similar systems expect.
+//
+// The package doesn't depend on any MQTT library.  Instead, the
+// connection is provided as a Client, which is easily implemented on
+// top of, for instance, github.com/eclipse/paho.mqtt.golang:
+//
+//	type pahoClient struct{ c mqtt.Client }
+//
+//	func (p pahoClient) Publish(topic string, retained bool, payload []byte) error {
+//		t := p.c.Publish(topic, 1, retained, payload)
+//		t.Wait()
+//		return t.Error()
+//	}
+//
+//	func (p pahoClient) Subscribe(topic string, handler func(topic string, payload []byte)) error {
+//		t := p.c.Subscribe(topic, 1, func(_ mqtt.Client, m mqtt.Message) {
+//			handler(m.Topic(), m.Payload())
+//		})
+//		t.Wait()
+//		return t.Error()
+//	}
+package myqmqtt
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joeshaw/myq"
+)
+
+// DefaultInterval is how often Publish reads the state of the devices
+// if Options.Interval isn't set
+const DefaultInterval = time.Minute
+
+// Options configures Publish
+type Options struct {
+	// Interval is how often the state of the devices is read.  If
+	// zero, DefaultInterval is used.
+	Interval time.Duration
+
+	// Logger, if set, receives failures to publish to the broker.  A
+	// *log.Logger satisfies this interface.
+	Logger myq.Logger
+}
+
+// message is a message to publish
+type message struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+func (o *Options) interval() time.Duration {
+	if o == nil || o.Interval <= 0 {
+		return DefaultInterval
+	}
+	return o.Interval
+}
+
+func (o *Options) logf(format string, args ...interface{}) {
+	if o != nil && o.Logger != nil {
+		o.Logger.Printf(format, args...)
+	}
+}
+
+// Client is a connection to an MQTT broker
+type Client interface {
+	// Publish publishes payload to topic, retained by the broker if
+	// retained is true
+	Publish(topic string, retained bool, payload []byte) error
+
+	// Subscribe calls handler with each message published to topic,
+	// which may contain the single-level wildcard "+"
+	Subscribe(topic string, handler func(topic string, payload []byte)) error
+}
+
+// Publish publishes the state of each door opener every opts.Interval
+// until ctx is done, and then returns ctx.Err().  opts may be nil to use
+// the defaults.  The door state, such as myq.StateClosed, is published
+// to "<topicPrefix>/<serial>/state" and whether the device is online,
+// "true" or "false", to "<topicPrefix>/<serial>/online".  Both are
+// retained, so that new subscribers get the last known state.
+//
+// Whether the devices could be read from MyQ is published, retained,
+// to "<topicPrefix>/available" as "online" or "offline", for use as a
+// Home Assistant availability topic.  When they can't be, the error is
+// also published to "<topicPrefix>/error" and Publish tries again
+// after the interval.
+//
+// Messages that fail to publish are published again after the
+// interval, unless a newer message to the same topic has been
+// published by then, and each failure is logged to opts.Logger.
+func Publish(ctx context.Context, session myq.Controller, client Client, topicPrefix string, opts *Options) error {
+	prefix := strings.TrimSuffix(topicPrefix, "/")
+
+	t := time.NewTicker(opts.interval())
+	defer t.Stop()
+
+	// failed holds the messages that couldn't be published, by topic
+	failed := map[string]message{}
+
+	for {
+		retry := failed
+		failed = map[string]message{}
+
+		publish := func(m message) {
+			delete(retry, m.topic)
+			if err := client.Publish(m.topic, m.retained, m.payload); err != nil {
+				opts.logf("myqmqtt: publishing to %s failed, retrying in %v: %v", m.topic, opts.interval(), err)
+				failed[m.topic] = m
+			}
+		}
+
+		devices, err := session.Devices()
+		if err != nil {
+			publish(message{prefix + "/available", true, []byte("offline")})
+			publish(message{prefix + "/error", false, []byte(err.Error())})
+		} else {
+			publish(message{prefix + "/available", true, []byte("online")})
+		}
+
+		for _, d := range devices {
+			if !d.IsDoorOpener() {
+				continue
+			}
+
+			base := prefix + "/" + d.SerialNumber
+			publish(message{base + "/state", true, []byte(d.DoorState)})
+			publish(message{base + "/online", true, []byte(strconv.FormatBool(d.Online))})
+		}
+
+		// Whatever failed last time and hasn't been superseded
+		for _, m := range retry {
+			publish(m)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Subscribe moves doors in response to messages published to
+// "<topicPrefix>/<serial>/set" with the payload "open" or "close"
+// (myq.ActionOpen or myq.ActionClose).  Other payloads are ignored.
+// If the action fails, the error is published to
+// "<topicPrefix>/<serial>/error".
+func Subscribe(session myq.Controller, client Client, topicPrefix string) error {
+	prefix := strings.TrimSuffix(topicPrefix, "/")
+
+	return client.Subscribe(prefix+"/+/set", func(topic string, payload []byte) {
+		serialNumber := strings.TrimSuffix(strings.TrimPrefix(topic, prefix+"/"), "/set")
+		if serialNumber == "" || strings.Contains(serialNumber, "/") {
+			return
+		}
+
+		action := strings.ToLower(strings.TrimSpace(string(payload)))
+		if action != myq.ActionOpen && action != myq.ActionClose {
+			return
+		}
+
+		if err := session.SetDoorState(serialNumber, action); err != nil {
+			client.Publish(prefix+"/"+serialNumber+"/error", false, []byte(err.Error()))
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package myqmqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joeshaw/myq"
+	"github.com/joeshaw/myq/myqtest"
+)
+
+type received struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+// fakeClient records the messages published to it, failing to publish
+// to failTopic the first failures times
+type fakeClient struct {
+	mu       sync.Mutex
+	messages []received
+	handlers map[string]func(topic string, payload []byte)
+
+	failTopic string
+	failures  int
+}
+
+func (c *fakeClient) Publish(topic string, retained bool, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if topic == c.failTopic && c.failures > 0 {
+		c.failures--
+		return errors.New("broker unavailable")
+	}
+
+	c.messages = append(c.messages, received{topic, retained, string(payload)})
+	return nil
+}
+
+func (c *fakeClient) Subscribe(topic string, handler func(topic string, payload []byte)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.handlers == nil {
+		c.handlers = map[string]func(string, []byte){}
+	}
+	c.handlers[topic] = handler
+	return nil
+}
+
+// deliver calls the handler subscribed to pattern with a message
+// published to topic
+func (c *fakeClient) deliver(t *testing.T, pattern, topic, payload string) {
+	t.Helper()
+
+	c.mu.Lock()
+	handler := c.handlers[pattern]
+	c.mu.Unlock()
+
+	if handler == nil {
+		t.Fatalf("nothing subscribed to %s", pattern)
+	}
+	handler(topic, []byte(payload))
+}
+
+// published returns the payloads published to topic, in order
+func (c *fakeClient) published(topic string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var payloads []string
+	for _, m := range c.messages {
+		if m.topic == topic {
+			payloads = append(payloads, m.payload)
+		}
+	}
+	return payloads
+}
+
+// topics returns the topics published to, in order
+func (c *fakeClient) topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var topics []string
+	for _, m := range c.messages {
+		topics = append(topics, m.topic)
+	}
+	return topics
+}
+
+// flakySession fails to list the devices on the calls in fail,
+// counting from 1
+type flakySession struct {
+	*myqtest.FakeSession
+	fail map[int]bool
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *flakySession) Devices() ([]myq.Device, error) {
+	f.mu.Lock()
+	f.calls++
+	fail := f.fail[f.calls]
+	f.mu.Unlock()
+
+	if fail {
+		return nil, errors.New("rate limited")
+	}
+	return f.FakeSession.Devices()
+}
+
+// testLogger records the lines logged to it
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func garageDoor() myq.Device {
+	return myq.Device{
+		SerialNumber: "CG1",
+		Family:       "garagedoor",
+		DoorState:    myq.StateClosed,
+		Online:       true,
+	}
+}
+
+// publishUntil runs Publish until done returns true
+func publishUntil(t *testing.T, session myq.Controller, client *fakeClient, opts *Options, done func() bool) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		errc <- Publish(ctx, session, client, "myq/", opts)
+	}()
+
+	for i := 0; i < 500 && !done(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+}
+
+func TestPublishContinuesAfterError(t *testing.T) {
+	session := &flakySession{
+		FakeSession: myqtest.NewFakeSession(garageDoor()),
+		fail:        map[int]bool{1: true},
+	}
+	client := &fakeClient{}
+
+	publishUntil(t, session, client, &Options{Interval: 10 * time.Millisecond}, func() bool {
+		return len(client.published("myq/CG1/state")) > 0
+	})
+
+	if got := client.published("myq/error"); len(got) != 1 || got[0] != "rate limited" {
+		t.Errorf("got errors %q", got)
+	}
+	if got := client.published("myq/available"); len(got) < 2 || got[0] != "offline" || got[1] != "online" {
+		t.Errorf("got availability %q, want offline then online", got)
+	}
+	if got := client.published("myq/CG1/state"); len(got) == 0 || got[0] != myq.StateClosed {
+		t.Errorf("got states %q", got)
+	}
+	if got := client.published("myq/CG1/online"); len(got) == 0 || got[0] != "true" {
+		t.Errorf("got online %q", got)
+	}
+}
+
+// A message that fails to publish is published again on the next poll,
+// even if the devices can't be read then
+func TestPublishRetriesFailedPublish(t *testing.T) {
+	session := &flakySession{
+		FakeSession: myqtest.NewFakeSession(garageDoor()),
+		fail:        map[int]bool{2: true},
+	}
+	client := &fakeClient{failTopic: "myq/CG1/state", failures: 1}
+	logger := &testLogger{}
+
+	publishUntil(t, session, client, &Options{Interval: 10 * time.Millisecond, Logger: logger}, func() bool {
+		return len(client.published("myq/CG1/state")) > 0
+	})
+
+	// The second poll publishes the failure to read the devices and
+	// then retries the state
+	topics := strings.Join(client.topics(), " ")
+	if want := "myq/available myq/CG1/online myq/available myq/error myq/CG1/state"; !strings.HasPrefix(topics, want) {
+		t.Errorf("got topics %s, want them to start %s", topics, want)
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "broker unavailable") {
+		t.Errorf("got log %q", logger.lines)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	session := myqtest.NewFakeSession(garageDoor())
+	client := &fakeClient{}
+
+	if err := Subscribe(session, client, "myq/"); err != nil {
+		t.Fatal(err)
+	}
+
+	client.deliver(t, "myq/+/set", "myq/CG1/set", " Open\n")
+
+	// Ignored
+	client.deliver(t, "myq/+/set", "myq/CG1/set", "toggle")
+	client.deliver(t, "myq/+/set", "myq/CG1/extra/set", "close")
+
+	client.deliver(t, "myq/+/set", "myq/CG9/set", "close")
+
+	want := []myqtest.Action{{SerialNumber: "CG1", Action: myq.ActionOpen}}
+	if got := session.Actions(); len(got) != len(want) || got[0] != want[0] {
+		t.Errorf("got actions %+v, want %+v", got, want)
+	}
+
+	if got := client.published("myq/CG9/error"); len(got) != 1 || !strings.Contains(got[0], "not found") {
+		t.Errorf("got errors %q for an unknown device", got)
+	}
+	if got := client.published("myq/CG1/error"); len(got) != 0 {
+		t.Errorf("got errors %q for a successful action", got)
+	}
+}
@@ -0,0 +1,114 @@
+// Package myqtest provides utilities for testing code that uses the
+// myq package without talking to the MyQ service.
+package myqtest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/joeshaw/myq"
+)
+
+var _ myq.Controller = (*FakeSession)(nil)
+
+// Action records a call to FakeSession.SetDoorState
+type Action struct {
+	SerialNumber string
+	Action       string
+}
+
+// FakeSession is an in-memory implementation of myq.Controller.  Its
+// devices are scripted by the test, and actions issued to it are
+// recorded and applied to the door state immediately.  It is safe for
+// concurrent use.
+type FakeSession struct {
+	mu      sync.Mutex
+	devices []myq.Device
+	actions []Action
+}
+
+// NewFakeSession returns a FakeSession with the provided devices
+func NewFakeSession(devices ...myq.Device) *FakeSession {
+	return &FakeSession{devices: append([]myq.Device(nil), devices...)}
+}
+
+// SetState sets the door state of the device with the provided serial
+// number, as if the door had been moved outside of the program under
+// test
+func (f *FakeSession) SetState(serialNumber, state string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d := f.find(serialNumber)
+	if d == nil {
+		return fmt.Errorf("device %s: %w", serialNumber, myq.ErrDeviceNotFound)
+	}
+
+	d.DoorState = state
+	return nil
+}
+
+// Actions returns the actions issued with SetDoorState, in order
+func (f *FakeSession) Actions() []Action {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Action(nil), f.actions...)
+}
+
+// Devices returns the scripted devices
+func (f *FakeSession) Devices() ([]myq.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]myq.Device(nil), f.devices...), nil
+}
+
+// DeviceState returns the door state of the device with the provided
+// serial number
+func (f *FakeSession) DeviceState(serialNumber string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d := f.find(serialNumber)
+	if d == nil {
+		return "", fmt.Errorf("device %s: %w", serialNumber, myq.ErrDeviceNotFound)
+	}
+
+	return d.DoorState, nil
+}
+
+// SetDoorState records the action and moves the door to the resulting
+// state
+func (f *FakeSession) SetDoorState(serialNumber, action string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d := f.find(serialNumber)
+	if d == nil {
+		return fmt.Errorf("device %s: %w", serialNumber, myq.ErrDeviceNotFound)
+	}
+
+	switch action {
+	case myq.ActionOpen:
+		d.DoorState = myq.StateOpen
+	case myq.ActionClose:
+		d.DoorState = myq.StateClosed
+	case myq.ActionStop:
+		d.DoorState = myq.StateStopped
+	default:
+		return fmt.Errorf("unsupported action %q", action)
+	}
+
+	f.actions = append(f.actions, Action{SerialNumber: serialNumber, Action: action})
+	return nil
+}
+
+func (f *FakeSession) find(serialNumber string) *myq.Device {
+	for i := range f.devices {
+		if f.devices[i].SerialNumber == serialNumber {
+			return &f.devices[i]
+		}
+	}
+	return nil
+}
@@ -1,11 +1,16 @@
 package myq
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -14,54 +19,210 @@ import (
 	"golang.org/x/net/html"
 )
 
-const oauthAuthorizeEndpoint = "https://partner-identity.myq-cloud.com/connect/authorize"
+// OAuth client parameters of the MyQ mobile app, which this package
+// uses to log in.  They are exported so that tools can report which
+// values a build is using when MyQ changes them.
+const (
+	OAuthClientID          = "IOS_CGI_MYQ"
+	OAuthRedirectURI       = "com.myqops://ios"
+	OAuthAuthorizeEndpoint = identityHost + authorizePath
+	OAuthTokenEndpoint     = identityHost + tokenPath
+)
+
+// OAuthRedirectURIs are the redirect URIs tried, in order, when logging
+// in.  MyQ has used different redirect URIs across app versions, and
+// if the authorization callback doesn't carry a code for one of them
+// the login is retried with the next.  Add to this list if MyQ
+// introduces a new one.
+var OAuthRedirectURIs = []string{
+	OAuthRedirectURI,
+	"com.myqops://android",
+}
+
+// PKCE code challenge methods, RFC 7636 Section 4.2
+const (
+	PKCEMethodS256  = "S256"
+	PKCEMethodPlain = "plain"
+)
+
+// oauthApp is the OAuth client registration of a brand's MyQ app
+type oauthApp struct {
+	clientID, clientSecret string
+
+	// scope is the space-separated list of scopes requested
+	scope string
+}
+
+// brandApps are the OAuth clients of the apps of the brands selling
+// MyQ devices.  Only the client of the LiftMaster app, which logs in
+// with any MyQ account, is known; the other brands' apps aren't known
+// to use different ones, so they are given the same client until
+// their own are found.
+var brandApps = map[string]oauthApp{
+	"liftmaster":  {OAuthClientID, oauthClientSecret, oauthScope},
+	"chamberlain": {OAuthClientID, oauthClientSecret, oauthScope},
+	"craftsman":   {OAuthClientID, oauthClientSecret, oauthScope},
+}
+
+var (
+	errNoAuthorizationCode       = errors.New("no authorization code in OAuth callback")
+	errVerificationTokenRejected = errors.New("login form verification token rejected")
+)
+
+const (
+	oauthClientSecret = "VUQ0RFhuS3lQV3EyNUJTdw=="
+
+	identityHost  = "https://partner-identity.myq-cloud.com"
+	authorizePath = "/connect/authorize"
+	tokenPath     = "/connect/token"
+	revokePath    = "/connect/revocation"
+
+	// oauthScope is the space-separated list of scopes requested
+	oauthScope = "MyQ_Residential offline_access"
+
+	// defaultBrand is the brand whose app's OAuth client is used if
+	// a Session doesn't specify one
+	defaultBrand = "liftmaster"
+
+	// defaultLocale is the login page locale the form parser is
+	// known to work with
+	defaultLocale = "en-US"
+)
 
 type oauth struct {
-	jar                 *cookiejar.Jar
+	// client is the base client for all requests in the flow.  Each
+	// step uses a copy of it with the flow's cookie jar and redirect
+	// policy.
+	client *http.Client
+
+	// baseURL is the identity service the flow runs against
+	baseURL string
+
+	redirectURI string
+
+	// app is the OAuth client the flow logs in as
+	app oauthApp
+
+	// locale is the ui_locales value requested for the login page
+	locale string
+
+	jar                 http.CookieJar
+	challengeMethod     string
 	challenge, verifier string
-	verificationToken   string
+	form                *loginForm
 }
 
-func newOAuth() (*oauth, error) {
-	jar, err := cookiejar.New(nil)
-	if err != nil {
+// loginForm describes the login form on the MyQ sign-in page.  The
+// page is localized based on the account's language, so everything
+// here is derived from element attributes and form structure rather
+// than from any visible text.
+type loginForm struct {
+	action            string
+	emailField        string
+	passwordField     string
+	verificationToken string
+}
+
+// newOAuth starts a new flow.  If jar is nil, the flow uses a new,
+// empty cookie jar.
+func newOAuth(client *http.Client, baseURL, redirectURI string, jar http.CookieJar) (*oauth, error) {
+	if jar == nil {
+		var err error
+		if jar, err = cookiejar.New(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	o := &oauth{
+		client:      client,
+		baseURL:     baseURL,
+		redirectURI: redirectURI,
+		app:         brandApps[defaultBrand],
+		locale:      defaultLocale,
+		jar:         jar,
+	}
+
+	if err := o.usePKCE(PKCEMethodS256, ""); err != nil {
 		return nil, err
 	}
 
-	challenge, verifier := pkceChallenge()
+	return o, nil
+}
 
-	return &oauth{
-		jar:       jar,
-		challenge: challenge,
-		verifier:  verifier,
-	}, nil
+// useBrand sets the flow's OAuth client to that of the provided brand's
+// app, such as "chamberlain"
+func (o *oauth) useBrand(brand string) error {
+	app, ok := brandApps[strings.ToLower(brand)]
+	if !ok {
+		return fmt.Errorf("unknown MyQ brand %q", brand)
+	}
+	o.app = app
+	return nil
+}
+
+// usePKCE sets the flow's PKCE code challenge method and code verifier.
+// If verifier is empty, a random one is generated.
+func (o *oauth) usePKCE(method, verifier string) error {
+	if method == "" {
+		method = PKCEMethodS256
+	}
+
+	if verifier == "" {
+		verifier = pkceVerifier()
+	}
+
+	challenge, err := pkceChallenge(method, verifier)
+	if err != nil {
+		return err
+	}
+
+	o.challengeMethod = method
+	o.challenge = challenge
+	o.verifier = verifier
+	return nil
+}
+
+// httpClient returns a copy of the flow's base client that uses the
+// flow's cookie jar, and follows redirects only if followRedirects is
+// set.
+func (o *oauth) httpClient(followRedirects bool) *http.Client {
+	client := *o.client
+	client.Jar = o.jar
+
+	if !followRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	return &client
 }
 
 // Start an OAuth login flow, which redirects us to an HTML page that
 // contains a form from which we have to extract a request verification
 // token.
-func (o *oauth) authorize() (*url.URL, error) {
-	u, err := url.Parse(oauthAuthorizeEndpoint)
+func (o *oauth) authorize(ctx context.Context) (*url.URL, error) {
+	u, err := url.Parse(o.baseURL + authorizePath)
 	if err != nil {
 		return nil, err
 	}
 
 	params := url.Values{}
-	params.Set("client_id", "IOS_CGI_MYQ")
+	params.Set("client_id", o.app.clientID)
 	params.Set("code_challenge", o.challenge)
-	params.Set("code_challenge_method", "S256")
-	params.Set("redirect_uri", "com.myqops://ios")
+	params.Set("code_challenge_method", o.challengeMethod)
+	params.Set("redirect_uri", o.redirectURI)
 	params.Set("response_type", "code")
-	params.Set("scope", "MyQ_Residential offline_access")
+	params.Set("scope", o.app.scope)
+	params.Set("ui_locales", o.locale)
 	u.RawQuery = params.Encode()
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
-	client.Jar = o.jar
+	client := o.httpClient(true)
 
 	resp, err := doRequest(client, req)
 	if err != nil {
@@ -77,27 +238,37 @@ func (o *oauth) authorize() (*url.URL, error) {
 	if err != nil {
 		return nil, err
 	}
-	tok := verificationToken(doc)
 
-	if tok == "" {
+	form := parseLoginForm(doc)
+	if form.verificationToken == "" {
 		return nil, fmt.Errorf("unable to extract verification token from login page")
 	}
 
-	o.verificationToken = tok
+	o.form = form
 
-	return resp.Request.URL, nil
+	u = resp.Request.URL
+	if form.action != "" {
+		action, err := u.Parse(form.action)
+		if err != nil {
+			return nil, err
+		}
+		u = action
+	}
+
+	return u, nil
 }
 
 // Log into the MyQ service.  This responds with a 302 redirect to the
 // oauth authorization callback, which we intercept.  The redirect URL
 // is returned.
-func (o *oauth) login(u *url.URL, email, password string) (*url.URL, error) {
+func (o *oauth) login(ctx context.Context, u *url.URL, email, password string) (*url.URL, error) {
 	params := url.Values{}
-	params.Set("Email", email)
-	params.Set("Password", password)
-	params.Set("__RequestVerificationToken", o.verificationToken)
+	params.Set(o.form.emailField, email)
+	params.Set(o.form.passwordField, password)
+	params.Set("__RequestVerificationToken", o.form.verificationToken)
 
-	req, err := http.NewRequest(
+	req, err := http.NewRequestWithContext(
+		ctx,
 		"POST",
 		u.String(),
 		strings.NewReader(params.Encode()),
@@ -108,13 +279,7 @@ func (o *oauth) login(u *url.URL, email, password string) (*url.URL, error) {
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	client := &http.Client{}
-	client.Jar = o.jar
-
-	// Prevent the HTTP client from redirecting
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}
+	client := o.httpClient(false)
 
 	resp, err := doRequest(client, req)
 	if err != nil {
@@ -122,26 +287,49 @@ func (o *oauth) login(u *url.URL, email, password string) (*url.URL, error) {
 	}
 	defer drain(resp.Body)
 
-	if resp.StatusCode != http.StatusFound {
+	switch resp.StatusCode {
+	case http.StatusFound:
+		loc, err := resp.Location()
+		if err == nil && isConsentURL(loc) {
+			return nil, ErrConsentRequired
+		}
+		if err == nil && isLoginURL(loc) {
+			return nil, ErrInvalidCredentials
+		}
+		return loc, err
+
+	case http.StatusOK:
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if isConsentPage(bytes.NewReader(b)) {
+			return nil, ErrConsentRequired
+		}
+		// A rejected username or password re-renders the login
+		// form rather than redirecting.
+		if isLoginPage(b) {
+			return nil, ErrInvalidCredentials
+		}
 		return nil, fmt.Errorf("received unexpected HTTP status code %d", resp.StatusCode)
-	}
 
-	return resp.Location()
+	case http.StatusBadRequest:
+		// The identity service rejects a form whose request
+		// verification token has expired with a bare 400.
+		return nil, errVerificationTokenRejected
+
+	default:
+		return nil, fmt.Errorf("received unexpected HTTP status code %d", resp.StatusCode)
+	}
 }
 
-func (o *oauth) callback(u *url.URL) (*url.URL, error) {
-	req, err := http.NewRequest("GET", u.String(), nil)
+func (o *oauth) callback(ctx context.Context, u *url.URL) (*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
-	client.Jar = o.jar
-
-	// Prevent the HTTP client from redirecting
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}
+	client := o.httpClient(false)
 
 	resp, err := doRequest(client, req)
 	if err != nil {
@@ -149,103 +337,270 @@ func (o *oauth) callback(u *url.URL) (*url.URL, error) {
 	}
 	defer drain(resp.Body)
 
+	if resp.StatusCode == http.StatusOK && isConsentPage(resp.Body) {
+		return nil, ErrConsentRequired
+	}
+
 	if resp.StatusCode != http.StatusFound {
 		return nil, fmt.Errorf("received unexpected HTTP status code %d", resp.StatusCode)
 	}
 
-	return resp.Location()
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, err
+	}
+
+	if isConsentURL(loc) {
+		return nil, ErrConsentRequired
+	}
+
+	if loc.Query().Get("code") == "" {
+		return nil, errNoAuthorizationCode
+	}
+
+	return loc, nil
+}
+
+// isConsentURL reports whether u is the identity service's consent
+// page, to which it redirects users who must accept new terms
+func isConsentURL(u *url.URL) bool {
+	return strings.Contains(strings.ToLower(u.Path), "/consent")
+}
+
+// isLoginURL reports whether u is the login page, which the identity
+// service redirects back to when it rejects the credentials
+func isLoginURL(u *url.URL) bool {
+	return strings.Contains(strings.ToLower(u.Path), "/account/login")
+}
+
+// isLoginPage reports whether page is the login form
+func isLoginPage(page []byte) bool {
+	return bytes.Contains(bytes.ToLower(page), []byte(`type="password"`))
+}
+
+// isConsentPage reports whether the page read from r asks the user to
+// consent to the app's access, rather than redirecting to the consent
+// page
+func isConsentPage(r io.Reader) bool {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return false
+	}
+
+	page := strings.ToLower(string(b))
+	return strings.Contains(page, `name="scopesconsented"`) || strings.Contains(page, `action="/consent`)
 }
 
-func (o *oauth) token(u *url.URL) (string, error) {
+// tokenResponse is the response from the token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+
+	// Set in error responses, RFC 6749 Section 5.2
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange the authorization code from the callback URL for a token.
+func (o *oauth) token(ctx context.Context, u *url.URL) (*tokenResponse, error) {
 	params := url.Values{}
-	params.Set("client_id", "IOS_CGI_MYQ")
-	params.Set("client_secret", "VUQ0RFhuS3lQV3EyNUJTdw==")
+	params.Set("client_id", o.app.clientID)
+	params.Set("client_secret", o.app.clientSecret)
 	params.Set("code", u.Query().Get("code"))
 	params.Set("code_verifier", o.verifier)
 	params.Set("grant_type", "authorization_code")
-	params.Set("redirect_uri", "com.myqops://ios")
+	params.Set("redirect_uri", o.redirectURI)
 	params.Set("scope", u.Query().Get("scope"))
 
-	req, err := http.NewRequest(
+	return o.tokenRequest(ctx, params)
+}
+
+// Exchange a refresh token for a new token.
+func (o *oauth) refresh(ctx context.Context, refreshToken string) (*tokenResponse, error) {
+	params := url.Values{}
+	params.Set("client_id", o.app.clientID)
+	params.Set("client_secret", o.app.clientSecret)
+	params.Set("grant_type", "refresh_token")
+	params.Set("redirect_uri", o.redirectURI)
+	params.Set("refresh_token", refreshToken)
+
+	return o.tokenRequest(ctx, params)
+}
+
+// Revoke a token, RFC 7009.  hint is the type of token,
+// "access_token" or "refresh_token".
+func (o *oauth) revoke(ctx context.Context, token, hint string) error {
+	params := url.Values{}
+	params.Set("client_id", o.app.clientID)
+	params.Set("client_secret", o.app.clientSecret)
+	params.Set("token", token)
+	params.Set("token_type_hint", hint)
+
+	req, err := http.NewRequestWithContext(
+		ctx,
 		"POST",
-		"https://partner-identity.myq-cloud.com/connect/token",
+		o.baseURL+revokePath,
 		strings.NewReader(params.Encode()),
 	)
 	if err != nil {
-		return "", err
+		return err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	client := &http.Client{}
-	client.Jar = o.jar
+	resp, err := doRequest(o.httpClient(true), req)
+	if err != nil {
+		return err
+	}
+	defer drain(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received unexpected HTTP status code %d revoking %s", resp.StatusCode, hint)
+	}
+	return nil
+}
+
+func (o *oauth) tokenRequest(ctx context.Context, params url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		o.baseURL+tokenPath,
+		strings.NewReader(params.Encode()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := o.httpClient(true)
 
 	resp, err := doRequest(client, req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer drain(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("received unexpected HTTP status code %d", resp.StatusCode)
+		return nil, fmt.Errorf("received unexpected HTTP status code %d", resp.StatusCode)
 	}
 
-	var tokenResponse struct {
-		AccessToken  string `json:"access_token"`
-		ExpiresIn    int    `json:"expires_in"`
-		TokenType    string `json:"token_type"`
-		RefreshToken string `json:"refresh_token"`
-		Scope        string `json:"scope"`
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("decoding token response: %w", err)
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
-		return "", err
+	// Storing an empty token would only lead to a confusing cycle of
+	// rejected requests and logins.
+	if tr.AccessToken == "" {
+		switch {
+		case tr.ErrorDescription != "":
+			return nil, fmt.Errorf("token response has no access token: %s: %s", tr.Error, tr.ErrorDescription)
+		case tr.Error != "":
+			return nil, fmt.Errorf("token response has no access token: %s", tr.Error)
+		default:
+			return nil, errors.New("token response has no access token")
+		}
 	}
 
-	return tokenResponse.AccessToken, nil
+	return &tr, nil
 }
 
-// RFC 7636, Section 4
-func pkceChallenge() (challenge, verifier string) {
-	enc := base64.URLEncoding.WithPadding(base64.NoPadding)
+var pkceEncoding = base64.URLEncoding.WithPadding(base64.NoPadding)
 
+// RFC 7636, Section 4.1
+func pkceVerifier() string {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
 		panic(err)
 	}
-	verifier = enc.EncodeToString(b)
+	return pkceEncoding.EncodeToString(b)
+}
 
-	h := sha256.New()
-	h.Write([]byte(verifier))
-	challenge = enc.EncodeToString(h.Sum(nil))
-	return challenge, verifier
+// RFC 7636, Section 4.2
+func pkceChallenge(method, verifier string) (string, error) {
+	switch method {
+	case PKCEMethodS256:
+		h := sha256.New()
+		h.Write([]byte(verifier))
+		return pkceEncoding.EncodeToString(h.Sum(nil)), nil
+	case PKCEMethodPlain:
+		return verifier, nil
+	default:
+		return "", fmt.Errorf("unsupported PKCE code challenge method %q", method)
+	}
 }
 
-func verificationToken(doc *html.Node) string {
-	var walk func(n *html.Node) string
-	walk = func(n *html.Node) string {
+// parseLoginForm finds the login form in the parsed sign-in page.  The
+// form is identified by the request verification token it contains,
+// and the credential fields by their input types.  If the form lacks
+// recognizable credential fields, the historical "Email" and
+// "Password" names are used.
+func parseLoginForm(doc *html.Node) *loginForm {
+	form := &loginForm{
+		emailField:    "Email",
+		passwordField: "Password",
+	}
+
+	var formNode *html.Node
+	var walk func(n *html.Node) bool
+	walk = func(n *html.Node) bool {
 		if n.Type == html.ElementNode && n.Data == "input" {
-			var name, value string
-
-			for _, a := range n.Attr {
-				switch a.Key {
-				case "name":
-					name = a.Val
-				case "value":
-					value = a.Val
-				}
+			if attr(n, "name") == "__RequestVerificationToken" && attr(n, "value") != "" {
+				form.verificationToken = attr(n, "value")
+				formNode = enclosingForm(n)
+				return true
 			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if walk(c) {
+				return true
+			}
+		}
+		return false
+	}
+	walk(doc)
 
-			if name == "__RequestVerificationToken" && value != "" {
-				return value
+	if formNode == nil {
+		return form
+	}
+
+	form.action = attr(formNode, "action")
+
+	var fields func(n *html.Node)
+	fields = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "input" && attr(n, "name") != "" {
+			switch strings.ToLower(attr(n, "type")) {
+			case "email":
+				form.emailField = attr(n, "name")
+			case "password":
+				form.passwordField = attr(n, "name")
 			}
 		}
 		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			if v := walk(c); v != "" {
-				return v
-			}
+			fields(c)
 		}
-		return ""
 	}
+	fields(formNode)
 
-	return walk(doc)
+	return form
+}
+
+func enclosingForm(n *html.Node) *html.Node {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Type == html.ElementNode && p.Data == "form" {
+			return p
+		}
+	}
+	return nil
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
 }
@@ -0,0 +1,403 @@
+package myq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// testOAuth returns a flow against srv
+func testOAuth(t *testing.T, srv *httptest.Server) *oauth {
+	t.Helper()
+
+	o, err := newOAuth(srv.Client(), srv.URL, OAuthRedirectURI, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// readFixture returns the contents of the named file in testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func parseFixture(t *testing.T, name string) *html.Node {
+	t.Helper()
+
+	doc, err := html.Parse(bytes.NewReader(readFixture(t, name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestParseLoginForm(t *testing.T) {
+	form := parseLoginForm(parseFixture(t, "login_en-US.html"))
+
+	want := loginForm{
+		action:            "/Account/LoginWithEmail?ReturnUrl=%2Fconnect%2Fauthorize%2Fcallback%3Fclient_id%3DIOS_CGI_MYQ",
+		emailField:        "Email",
+		passwordField:     "Password",
+		verificationToken: "CfDJ8EnUsVerificationToken",
+	}
+	if *form != want {
+		t.Errorf("got %+v, want %+v", *form, want)
+	}
+}
+
+// The German login page labels its fields differently, uses other field
+// names, and has a second form with an email field ahead of the login
+// form
+func TestParseLoginFormGerman(t *testing.T) {
+	form := parseLoginForm(parseFixture(t, "login_de-DE.html"))
+
+	want := loginForm{
+		action:            "/Account/LoginWithEmail?ReturnUrl=%2Fconnect%2Fauthorize%2Fcallback&culture=de-DE",
+		emailField:        "Input.Email",
+		passwordField:     "Input.Passwort",
+		verificationToken: "CfDJ8DeDeVerificationToken",
+	}
+	if *form != want {
+		t.Errorf("got %+v, want %+v", *form, want)
+	}
+}
+
+func TestParseLoginFormDefaults(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<form action="/login">
+		<input name="user"><input name="pass">
+		<input name="__RequestVerificationToken" type="hidden" value="tok">
+	</form>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := parseLoginForm(doc)
+	if form.emailField != "Email" || form.passwordField != "Password" {
+		t.Errorf("got fields %q and %q, want the defaults", form.emailField, form.passwordField)
+	}
+	if form.verificationToken != "tok" || form.action != "/login" {
+		t.Errorf("got token %q and action %q", form.verificationToken, form.action)
+	}
+}
+
+func TestParseLoginFormNoToken(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<form><input type="email" name="e"></form>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if form := parseLoginForm(doc); form.verificationToken != "" {
+		t.Errorf("got verification token %q, want none", form.verificationToken)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	page := readFixture(t, "login_en-US.html")
+
+	var query url.Values
+	mux := http.NewServeMux()
+	mux.HandleFunc(authorizePath, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		http.Redirect(w, r, "/Account/Login?ReturnUrl=x", http.StatusFound)
+	})
+	mux.HandleFunc("/Account/Login", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	o := testOAuth(t, srv)
+	u, err := o.authorize(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := query.Get("code_challenge"); got != o.challenge {
+		t.Errorf("got code challenge %q, want %q", got, o.challenge)
+	}
+	if got := query.Get("ui_locales"); got != defaultLocale {
+		t.Errorf("got ui_locales %q, want %q", got, defaultLocale)
+	}
+
+	// The form action is resolved against the login page
+	if u.Host != strings.TrimPrefix(srv.URL, "http://") || u.Path != "/Account/LoginWithEmail" {
+		t.Errorf("got login URL %s", u)
+	}
+	if o.form.verificationToken != "CfDJ8EnUsVerificationToken" {
+		t.Errorf("got verification token %q", o.form.verificationToken)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	loginPage := readFixture(t, "login_en-US.html")
+	consentPage := readFixture(t, "consent.html")
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantLoc string
+		wantErr error
+	}{
+		{
+			name: "redirect to callback",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "/connect/authorize/callback?client_id=IOS_CGI_MYQ", http.StatusFound)
+			},
+			wantLoc: "/connect/authorize/callback",
+		},
+		{
+			name: "redirect to login",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "/Account/Login?error=1", http.StatusFound)
+			},
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "redirect to consent",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "/consent?returnUrl=x", http.StatusFound)
+			},
+			wantErr: ErrConsentRequired,
+		},
+		{
+			name: "login form shown again",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(loginPage)
+			},
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "consent page",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(consentPage)
+			},
+			wantErr: ErrConsentRequired,
+		},
+		{
+			name: "verification token rejected",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+			},
+			wantErr: errVerificationTokenRejected,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var form url.Values
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				form = r.PostForm
+				tt.handler(w, r)
+			}))
+			defer srv.Close()
+
+			o := testOAuth(t, srv)
+			o.form = &loginForm{
+				emailField:        "Input.Email",
+				passwordField:     "Input.Password",
+				verificationToken: "tok",
+			}
+
+			u, _ := url.Parse(srv.URL + "/Account/LoginWithEmail")
+			loc, err := o.login(context.Background(), u, "user@example.com", "hunter2")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && loc.Path != tt.wantLoc {
+				t.Errorf("got location %s, want path %s", loc, tt.wantLoc)
+			}
+
+			if form.Get("Input.Email") != "user@example.com" || form.Get("Input.Password") != "hunter2" || form.Get("__RequestVerificationToken") != "tok" {
+				t.Errorf("got form %v", form)
+			}
+		})
+	}
+}
+
+func TestLoginUnexpectedStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	o := testOAuth(t, srv)
+	o.form = &loginForm{emailField: "Email", passwordField: "Password"}
+
+	u, _ := url.Parse(srv.URL)
+	if _, err := o.login(context.Background(), u, "user", "pass"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestCallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		wantErr  error
+	}{
+		{"code", OAuthRedirectURI + "?code=abc&scope=MyQ_Residential", nil},
+		{"missing code", OAuthRedirectURI + "?error=access_denied", errNoAuthorizationCode},
+		{"consent", "/consent?returnUrl=x", ErrConsentRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Location", tt.location)
+				w.WriteHeader(http.StatusFound)
+			}))
+			defer srv.Close()
+
+			o := testOAuth(t, srv)
+			u, _ := url.Parse(srv.URL + "/connect/authorize/callback")
+			loc, err := o.callback(context.Background(), u)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && loc.Query().Get("code") != "abc" {
+				t.Errorf("got location %s", loc)
+			}
+		})
+	}
+}
+
+func TestCallbackConsentPage(t *testing.T) {
+	page := readFixture(t, "consent.html")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(page)
+	}))
+	defer srv.Close()
+
+	o := testOAuth(t, srv)
+	u, _ := url.Parse(srv.URL + "/connect/authorize/callback")
+	if _, err := o.callback(context.Background(), u); err != ErrConsentRequired {
+		t.Fatalf("got error %v, want ErrConsentRequired", err)
+	}
+}
+
+func TestIsConsentPage(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    bool
+	}{
+		{"consent.html", true},
+		{"login_en-US.html", false},
+		{"login_de-DE.html", false},
+	}
+
+	for _, tt := range tests {
+		if got := isConsentPage(bytes.NewReader(readFixture(t, tt.fixture))); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.fixture, got, tt.want)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != tokenPath {
+			t.Errorf("got %s %s", r.Method, r.URL.Path)
+		}
+		r.ParseForm()
+		form = r.PostForm
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access",
+			"expires_in":    1800,
+			"token_type":    "Bearer",
+			"refresh_token": "refresh",
+			"scope":         "MyQ_Residential offline_access",
+		})
+	}))
+	defer srv.Close()
+
+	o := testOAuth(t, srv)
+	u, _ := url.Parse(OAuthRedirectURI + "?code=abc&scope=MyQ_Residential")
+	tr, err := o.token(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.AccessToken != "access" || tr.RefreshToken != "refresh" || tr.ExpiresIn != 1800 {
+		t.Errorf("got token response %+v", tr)
+	}
+
+	want := map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          "abc",
+		"code_verifier": o.verifier,
+		"client_id":     OAuthClientID,
+		"redirect_uri":  OAuthRedirectURI,
+	}
+	for k, v := range want {
+		if got := form.Get(k); got != v {
+			t.Errorf("got %s %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestTokenRequestStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+	}))
+	defer srv.Close()
+
+	o := testOAuth(t, srv)
+	if _, err := o.refresh(context.Background(), "refresh"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestTokenRequestEmptyToken(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"empty", `{}`, "token response has no access token"},
+		{"empty token", `{"access_token":"","token_type":"Bearer"}`, "token response has no access token"},
+		{"error", `{"error":"invalid_grant"}`, "invalid_grant"},
+		{"error description", `{"error":"invalid_grant","error_description":"refresh token expired"}`, "refresh token expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			o := testOAuth(t, srv)
+			tr, err := o.refresh(context.Background(), "refresh")
+			if err == nil {
+				t.Fatalf("got token response %+v, want an error", tr)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %q, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
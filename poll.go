@@ -0,0 +1,63 @@
+package myq
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// PollJitter is the largest fraction by which the delays between polls
+// of a device, by WaitForOnline and Watch, are randomly lengthened, so
+// that several devices polled at once don't query MyQ in lockstep.
+// Zero disables it.
+var PollJitter = 0.1
+
+var (
+	rngMu sync.Mutex
+	rng   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Jitter returns d lengthened at random by up to PollJitter, for
+// programs running their own polling loops to spread out their
+// requests the same way as Watch
+func Jitter(d time.Duration) time.Duration {
+	return jitter(d, PollJitter)
+}
+
+// jitter returns d lengthened by a random fraction of up to frac
+func jitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 || d <= 0 {
+		return d
+	}
+
+	rngMu.Lock()
+	defer rngMu.Unlock()
+	return d + time.Duration(rng.Float64()*frac*float64(d))
+}
+
+// poll calls f until it reports done, returns an error, or ctx is
+// done.  The delay between calls starts at interval and doubles after
+// each call, up to maxInterval.
+func poll(ctx context.Context, interval, maxInterval time.Duration, f func() (done bool, err error)) error {
+	t := time.NewTimer(0)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		done, err := f()
+		if err != nil || done {
+			return err
+		}
+
+		t.Reset(jitter(interval, PollJitter))
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
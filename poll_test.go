@@ -0,0 +1,29 @@
+package myq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	const d = time.Minute
+
+	var lengthened bool
+	for i := 0; i < 100; i++ {
+		got := jitter(d, 0.1)
+		if got < d || got > d+6*time.Second {
+			t.Fatalf("got %v, want between %v and %v", got, d, d+6*time.Second)
+		}
+		lengthened = lengthened || got > d
+	}
+	if !lengthened {
+		t.Error("delay never lengthened")
+	}
+
+	if got := jitter(d, 0); got != d {
+		t.Errorf("got %v with no jitter, want %v", got, d)
+	}
+	if got := jitter(d, -1); got != d {
+		t.Errorf("got %v with negative jitter, want %v", got, d)
+	}
+}
@@ -0,0 +1,45 @@
+package myq
+
+import (
+	"context"
+	"net/http"
+)
+
+// profileEndpoint is the MyQ endpoint describing the logged-in user
+const profileEndpoint = accountsHost + "/api/v6.0/accounts/me"
+
+// Profile describes the user a Session is logged in as
+type Profile struct {
+	UserID    string
+	Email     string
+	FirstName string
+	LastName  string
+}
+
+type profileJSON struct {
+	UserID    jsonString `json:"user_id"`
+	Email     string     `json:"email"`
+	FirstName string     `json:"first_name"`
+	LastName  string     `json:"last_name"`
+}
+
+// Profile returns the profile of the logged-in user, for instance to
+// show which of several logins is in use
+func (s *Session) Profile(ctx context.Context) (Profile, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.versioned(profileEndpoint), nil)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	var body profileJSON
+	if err := s.apiRequestWithRetry(req, &body); err != nil {
+		return Profile{}, err
+	}
+
+	return Profile{
+		UserID:    string(body.UserID),
+		Email:     body.Email,
+		FirstName: body.FirstName,
+		LastName:  body.LastName,
+	}, nil
+}
@@ -0,0 +1,37 @@
+package myq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// RawAccounts returns the response of the MyQ accounts endpoint as
+// is, apart from email addresses, tokens and similar fields being
+// redacted, for instance to capture what MyQ returned when parsing
+// fails
+func (s *Session) RawAccounts(ctx context.Context) (json.RawMessage, error) {
+	return s.raw(ctx, s.versioned(AccountsEndpoint))
+}
+
+// RawDevices returns the first page of the response of the MyQ devices
+// endpoint for the account with the provided ID, redacted like
+// RawAccounts
+func (s *Session) RawDevices(ctx context.Context, accountID string) (json.RawMessage, error) {
+	return s.raw(ctx, s.versioned(fmt.Sprintf(DevicesEndpointFmt, accountID)))
+}
+
+func (s *Session) raw(ctx context.Context, endpoint string) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var body json.RawMessage
+	if err := s.apiRequestWithRetry(req, &body); err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(redactBody("application/json", body)), nil
+}
@@ -0,0 +1,72 @@
+package myq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Parameters are account ID and device serial number
+const schedulesEndpointFmt = doorOpenersHost + "/api/v5.2/Accounts/%s/door_openers/%s/schedules"
+
+// Schedule is a rule configured in the MyQ app to act on a device at a
+// set time, such as closing a door every night
+type Schedule struct {
+	ID      string
+	Name    string
+	Enabled bool
+
+	// Action is the action taken, such as ActionClose
+	Action string
+
+	// Time is the local time of day the schedule runs, as HH:MM
+	Time string
+
+	// Days are the days of the week the schedule runs
+	Days []string
+}
+
+type scheduleJSON struct {
+	ID      jsonString `json:"schedule_id"`
+	Name    string     `json:"name"`
+	Enabled jsonBool   `json:"enabled"`
+	Action  string     `json:"action"`
+	Time    string     `json:"time"`
+	Days    []string   `json:"days"`
+}
+
+// Schedules returns the schedules configured for the device with the
+// provided serial number
+func (s *Session) Schedules(serialNumber string) ([]Schedule, error) {
+	ctx := context.Background()
+
+	d, err := s.device(ctx, serialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := s.versioned(fmt.Sprintf(schedulesEndpointFmt, d.Account.ID, serialNumber))
+
+	var schedules []Schedule
+	err = s.listAll(ctx, endpoint, func(item json.RawMessage) error {
+		var sj scheduleJSON
+		if err := json.Unmarshal(item, &sj); err != nil {
+			return err
+		}
+
+		schedules = append(schedules, Schedule{
+			ID:      string(sj.ID),
+			Name:    sj.Name,
+			Enabled: bool(sj.Enabled),
+			Action:  sj.Action,
+			Time:    sj.Time,
+			Days:    sj.Days,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return schedules, nil
+}
@@ -0,0 +1,121 @@
+package myq
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is the most device names or serial numbers offered
+// by SuggestDevices
+const maxSuggestions = 3
+
+// NotFoundError is returned when no device has the requested serial
+// number.  It matches ErrDeviceNotFound with errors.Is.
+type NotFoundError struct {
+	SerialNumber string
+
+	// Suggestions are the closest matching names and serial numbers
+	// of known devices, if any
+	Suggestions []string
+}
+
+func (e *NotFoundError) Error() string {
+	if len(e.Suggestions) == 0 {
+		return fmt.Sprintf("device %s not found", e.SerialNumber)
+	}
+	return fmt.Sprintf("device %s not found (did you mean %s?)", e.SerialNumber, strings.Join(e.Suggestions, ", "))
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrDeviceNotFound
+}
+
+func (s *Session) notFound(serialNumber string) error {
+	return &NotFoundError{
+		SerialNumber: serialNumber,
+		Suggestions:  s.SuggestDevices(serialNumber),
+	}
+}
+
+// SuggestDevices returns the names and serial numbers of known devices
+// that are closest to query, best match first, for instance to help a
+// user who mistyped one.  Only devices from the last fetch of all
+// devices are considered; it returns nil if there hasn't been one.
+func (s *Session) SuggestDevices(query string) []string {
+	s.mu.Lock()
+	devices := s.lastDevices
+	s.mu.Unlock()
+
+	type candidate struct {
+		s    string
+		dist int
+	}
+
+	// Allow roughly one mistake for every three characters
+	limit := len(query) / 3
+	if limit < 1 {
+		limit = 1
+	}
+
+	q := strings.ToLower(query)
+	seen := map[string]bool{}
+	var candidates []candidate
+	for _, d := range devices {
+		for _, c := range []string{d.Name, d.SerialNumber} {
+			if c == "" || seen[c] {
+				continue
+			}
+			seen[c] = true
+
+			if dist := editDistance(q, strings.ToLower(c)); dist <= limit {
+				candidates = append(candidates, candidate{c, dist})
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].dist < candidates[j].dist
+	})
+
+	var suggestions []string
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		suggestions = append(suggestions, candidates[i].s)
+	}
+	return suggestions
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(br)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,112 @@
+package myq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// savedToken is the JSON representation of a Session's token written
+// by SaveToken
+type savedToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+	Scope        string    `json:"scope,omitempty"`
+}
+
+// SaveToken writes the Session's token, refresh token and token expiry
+// to w as JSON, to be restored with LoadToken by a later process
+// instead of logging in again.  They are credentials: store them as
+// carefully as the password.
+func (s *Session) SaveToken(w io.Writer) error {
+	s.mu.Lock()
+	t := savedToken{
+		AccessToken:  s.token,
+		RefreshToken: s.refreshToken,
+		Expiry:       s.tokenExpiry,
+		Scope:        s.scope,
+	}
+	s.mu.Unlock()
+
+	if t.AccessToken == "" {
+		return ErrNotLoggedIn
+	}
+
+	return json.NewEncoder(w).Encode(t)
+}
+
+// LoadToken restores a token written by SaveToken.  The token may have
+// expired since; check TokenValid to see whether to Refresh or Login.
+func (s *Session) LoadToken(r io.Reader) error {
+	var t savedToken
+	if err := json.NewDecoder(r).Decode(&t); err != nil {
+		return err
+	}
+
+	if t.AccessToken == "" {
+		return errors.New("saved token has no access token")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = t.AccessToken
+	s.refreshToken = t.RefreshToken
+	s.tokenExpiry = t.Expiry
+	s.scope = t.Scope
+	return nil
+}
+
+// Logout revokes the Session's token and refresh token with MyQ and
+// forgets them, along with the cached accounts and devices, so that
+// they can't be used to control the user's devices, for instance on a
+// shared machine.  The Session must log in again to be used.  The
+// tokens are forgotten even if revoking them fails.
+func (s *Session) Logout() error {
+	s.mu.Lock()
+	o, token, refreshToken := s.oauth, s.token, s.refreshToken
+
+	s.token = ""
+	s.tokenExpiry = time.Time{}
+	s.refreshToken = ""
+	s.scope = ""
+	s.oauth = nil
+	s.deviceAccounts = nil
+	s.lastDevices = nil
+	s.lastDevicesAt = time.Time{}
+	s.devicesCachedAt = time.Time{}
+	s.mu.Unlock()
+
+	s.accounts = nil
+
+	if token == "" && refreshToken == "" {
+		return nil
+	}
+
+	if o == nil {
+		var err error
+		if o, err = s.newOAuth(OAuthRedirectURI); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutOr(s.LoginTimeout, defaultLoginTimeout))
+	defer cancel()
+
+	// Revoking the refresh token first keeps a new token from being
+	// obtained with it should revoking the token fail
+	if refreshToken != "" {
+		if err := o.revoke(ctx, refreshToken, "refresh_token"); err != nil {
+			return err
+		}
+	}
+	if token != "" {
+		if err := o.revoke(ctx, token, "access_token"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
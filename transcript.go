@@ -0,0 +1,353 @@
+package myq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redacted replaces credentials, tokens and personal information in
+// transcripts
+const redacted = "REDACTED"
+
+// sensitiveKeys are substrings of the header, query, form and JSON
+// field names whose values are redacted from transcripts
+var sensitiveKeys = []string{"authorization", "cookie", "password", "token", "secret", "code", "verifier", "email", "username"}
+
+// publicFormKeys are the only form fields whose values are kept in
+// transcripts.  The login form's field names are localized, such as
+// "Input.Passwort" on the German page, so they can't be recognized by
+// name, and every other form value is redacted.
+var publicFormKeys = map[string]bool{"client_id": true, "grant_type": true, "redirect_uri": true, "scope": true}
+
+// TranscriptEntry is a single HTTP request and its response, recorded
+// by a Transcript
+type TranscriptEntry struct {
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeader  http.Header `json:"request_header,omitempty"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	StatusCode     int         `json:"status_code,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+	Error          string      `json:"error,omitempty"`
+}
+
+// Transcript records every HTTP request made to MyQ, and its response,
+// as a line of JSON, with credentials, tokens and email addresses
+// redacted.  A recorded transcript can be played back with Replay, for
+// instance to reproduce a broken login without the user's password.
+type Transcript struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewTranscript returns a Transcript that writes to w.  Install it by
+// setting the package's Recorder variable.
+func NewTranscript(w io.Writer) *Transcript {
+	return &Transcript{w: w}
+}
+
+// Err returns the first error encountered writing the transcript
+func (t *Transcript) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// record adds req and its response, or the error sending it, to the
+// transcript.  The response body is read in full and replaced so that
+// the caller can still read it.
+func (t *Transcript) record(req *http.Request, resp *http.Response, rerr error) {
+	e := TranscriptEntry{
+		Method:        req.Method,
+		URL:           redactURL(req.URL),
+		RequestHeader: redactHeader(req.Header),
+	}
+
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			b, _ := ioutil.ReadAll(body)
+			body.Close()
+			e.RequestBody = redactBody(req.Header.Get("Content-Type"), b)
+		}
+	}
+
+	if rerr != nil {
+		e.Error = rerr.Error()
+	}
+
+	if resp != nil {
+		e.StatusCode = resp.StatusCode
+		e.ResponseHeader = redactHeader(resp.Header)
+
+		// Keep any read error, such as ErrResponseTooLarge, for the
+		// caller to see
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body = &replayBody{Reader: bytes.NewReader(b), err: err, c: resp.Body}
+		e.ResponseBody = redactBody(resp.Header.Get("Content-Type"), b)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err != nil {
+		return
+	}
+	if err := json.NewEncoder(t.w).Encode(e); err != nil {
+		t.err = err
+	}
+}
+
+// replayBody is a response body that has already been read into
+// memory, failing with err once it has been read
+type replayBody struct {
+	*bytes.Reader
+	err error
+	c   io.Closer
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF && b.err != nil {
+		err = b.err
+	}
+	return n, err
+}
+
+func (b *replayBody) Close() error {
+	if b.c == nil {
+		return nil
+	}
+	return b.c.Close()
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactHeader(h http.Header) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+
+	r := make(http.Header, len(h))
+	for k, v := range h {
+		switch {
+		case isSensitive(k):
+			v = []string{redacted}
+		case http.CanonicalHeaderKey(k) == "Location":
+			// Redirects carry the authorization code in the query
+			if u, err := url.Parse(h.Get(k)); err == nil {
+				v = []string{redactURL(u)}
+			}
+		}
+		r[k] = v
+	}
+	return r
+}
+
+func redactValues(v url.Values) url.Values {
+	r := make(url.Values, len(v))
+	for k, vals := range v {
+		if isSensitive(k) {
+			vals = []string{redacted}
+		}
+		r[k] = vals
+	}
+	return r
+}
+
+func redactForm(v url.Values) url.Values {
+	r := make(url.Values, len(v))
+	for k, vals := range v {
+		if !publicFormKeys[k] {
+			vals = []string{redacted}
+		}
+		r[k] = vals
+	}
+	return r
+}
+
+func redactURL(u *url.URL) string {
+	r := *u
+	if r.RawQuery != "" {
+		r.RawQuery = redactValues(r.Query()).Encode()
+	}
+	return r.String()
+}
+
+// redactBody returns b as a string with form values other than
+// publicFormKeys and the values of sensitive JSON object fields
+// redacted, and with email addresses and form tokens redacted from
+// HTML pages
+func redactBody(contentType string, b []byte) string {
+	if contentType == "" {
+		contentType = http.DetectContentType(b)
+	}
+
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		v, err := url.ParseQuery(string(b))
+		if err != nil {
+			return redacted
+		}
+		return redactForm(v).Encode()
+
+	case strings.Contains(contentType, "json"):
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return string(b)
+		}
+		out, err := json.Marshal(redactJSON(v))
+		if err != nil {
+			return redacted
+		}
+		return string(out)
+
+	case strings.HasPrefix(contentType, "text/html"):
+		return redactHTML(string(b))
+
+	default:
+		return string(b)
+	}
+}
+
+var (
+	tokenInputRE = regexp.MustCompile(`(?i)<input[^>]*__RequestVerificationToken[^>]*>`)
+	valueAttrRE  = regexp.MustCompile(`(?i)(\svalue\s*=\s*)("[^"]*"|'[^']*'|[^\s>]+)`)
+)
+
+// redactHTML redacts the values of __RequestVerificationToken inputs
+// and any email addresses, which the login and consent pages echo back,
+// from the HTML page s
+func redactHTML(s string) string {
+	s = tokenInputRE.ReplaceAllStringFunc(s, func(tag string) string {
+		return valueAttrRE.ReplaceAllString(tag, `${1}"`+redacted+`"`)
+	})
+	return emailRE.ReplaceAllString(s, redacted)
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if isSensitive(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(val)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactJSON(v[i])
+		}
+	}
+	return v
+}
+
+// Replay is an http.RoundTripper that answers requests from a recorded
+// Transcript instead of contacting MyQ.  Each request is answered with
+// the first unused entry having the same method and URL, ignoring the
+// query string, whose values may have been redacted.
+type Replay struct {
+	mu      sync.Mutex
+	entries []TranscriptEntry
+	used    []bool
+}
+
+// NewReplay reads a transcript written by a Transcript from r.  To
+// replay it, use it as the Transport of a Session's HTTPClient.
+func NewReplay(r io.Reader) (*Replay, error) {
+	var entries []TranscriptEntry
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, int(MaxResponseSize)*2)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+
+		var e TranscriptEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("reading transcript entry %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Replay{entries: entries, used: make([]bool, len(entries))}, nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (r *Replay) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	want := withoutQuery(req.URL)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, e := range r.entries {
+		if r.used[i] || e.Method != req.Method {
+			continue
+		}
+
+		u, err := url.Parse(e.URL)
+		if err != nil || withoutQuery(u) != want {
+			continue
+		}
+
+		r.used[i] = true
+
+		if e.Error != "" {
+			return nil, errors.New(e.Error)
+		}
+
+		header := e.ResponseHeader
+		if header == nil {
+			header = http.Header{}
+		}
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+			StatusCode:    e.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          ioutil.NopCloser(strings.NewReader(e.ResponseBody)),
+			ContentLength: int64(len(e.ResponseBody)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no transcript entry for %s %s", req.Method, want)
+}
+
+func withoutQuery(u *url.URL) string {
+	r := *u
+	r.RawQuery = ""
+	r.Fragment = ""
+	return r.String()
+}
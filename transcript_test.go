@@ -0,0 +1,209 @@
+package myq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestRedactBodyHTML(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		secrets     []string
+	}{
+		{"login", "text/html; charset=utf-8", string(readFixture(t, "login_en-US.html")), []string{"CfDJ8EnUsVerificationToken"}},
+		{"consent", "text/html", string(readFixture(t, "consent.html")), []string{"CfDJ8ConsentVerificationToken"}},
+		{
+			"echoed email",
+			"text/html",
+			`<p>No account for <b>user@example.com</b></p><input type="email" value="user@example.com">`,
+			[]string{"user@example.com"},
+		},
+		{
+			"value before name",
+			"text/html",
+			`<input value='tok' type=hidden name=__RequestVerificationToken>`,
+			[]string{"tok"},
+		},
+		{
+			"no content type",
+			"",
+			`<!DOCTYPE html><html><input name="__RequestVerificationToken" value="tok"></html>`,
+			[]string{"tok"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactBody(tt.contentType, []byte(tt.body))
+			for _, s := range tt.secrets {
+				if strings.Contains(got, s) {
+					t.Errorf("%q not redacted from:\n%s", s, got)
+				}
+			}
+			if !strings.Contains(got, redacted) {
+				t.Errorf("nothing redacted from:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestRedactBodyHTMLKeepsForm(t *testing.T) {
+	body := readFixture(t, "login_en-US.html")
+
+	// The redacted page must still parse as a login form
+	doc, err := html.Parse(strings.NewReader(redactBody("text/html", body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form := parseLoginForm(doc); form.verificationToken != redacted {
+		t.Errorf("got token %q, want %q", form.verificationToken, redacted)
+	}
+}
+
+// Login form field names are localized, so credentials must be redacted
+// whatever the fields are called
+func TestTranscriptLoginForm(t *testing.T) {
+	for _, fixture := range []string{"login_en-US.html", "login_de-DE.html"} {
+		t.Run(fixture, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "/connect/authorize/callback?code=abc", http.StatusFound)
+			}))
+			defer srv.Close()
+
+			var buf bytes.Buffer
+			defer func(r *Transcript) { Recorder = r }(Recorder)
+			Recorder = NewTranscript(&buf)
+
+			o := testOAuth(t, srv)
+			o.form = parseLoginForm(parseFixture(t, fixture))
+
+			u, _ := url.Parse(srv.URL + o.form.action)
+			if _, err := o.login(context.Background(), u, "user@example.com", "hunter2"); err != nil {
+				t.Fatal(err)
+			}
+			if err := Recorder.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, s := range []string{"user@example.com", "user%40example.com", "hunter2", o.form.verificationToken} {
+				if strings.Contains(buf.String(), s) {
+					t.Errorf("%q not redacted from:\n%s", s, buf.String())
+				}
+			}
+		})
+	}
+}
+
+// fakeLogin serves the identity service's login flow, issuing f's
+// token, and passes the other requests on to f
+func fakeLogin(t *testing.T, f *fakeMyQ) http.Handler {
+	page := readFixture(t, "login_en-US.html")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(authorizePath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+	mux.HandleFunc("/Account/LoginWithEmail", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, authorizePath+"/callback", http.StatusFound)
+	})
+	mux.HandleFunc(authorizePath+"/callback", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", OAuthRedirectURI+"?code=abc&scope=MyQ_Residential")
+		w.WriteHeader(http.StatusFound)
+	})
+	mux.HandleFunc(tokenPath, func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		token := f.token
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  token,
+			"refresh_token": "refresh",
+			"expires_in":    1800,
+		})
+	})
+	mux.Handle("/", f)
+	return mux
+}
+
+func TestTranscriptReplay(t *testing.T) {
+	f := fakeAccounts()
+	f.addDevice("2", fakeDoor("CG5", "Shed", StateOpen))
+
+	s, srv := testSession(t, fakeLogin(t, f))
+	s.token = ""
+	s.Username = "user@example.com"
+	s.Password = "hunter2"
+
+	var buf bytes.Buffer
+	transcript := NewTranscript(&buf)
+	defer func(r *Transcript) { Recorder = r }(Recorder)
+	Recorder = transcript
+
+	if err := s.Login(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := s.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Recorder = nil
+	srv.Close()
+	if err := transcript.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"hunter2", "user@example.com", "user%40example.com", "Bearer token", `"access_token":"token"`} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("%q not redacted from transcript:\n%s", secret, buf.String())
+		}
+	}
+
+	replay, err := NewReplay(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Session{
+		Username:   "user@example.com",
+		Password:   "hunter2",
+		HTTPClient: &http.Client{Transport: replay},
+	}
+	if err := r.Login(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(want) != 5 || len(got) != len(want) {
+		t.Fatalf("got %d devices, want %d", len(got), len(want))
+	}
+	serials := map[string]string{}
+	for _, d := range want {
+		serials[d.SerialNumber] = d.DoorState
+	}
+	for _, d := range got {
+		if state, ok := serials[d.SerialNumber]; !ok || state != d.DoorState {
+			t.Errorf("got device %s in state %q, want %q", d.SerialNumber, d.DoorState, state)
+		}
+	}
+
+	// Every entry has been used, so further requests fail
+	if _, err := r.Devices(); err == nil || !strings.Contains(err.Error(), "no transcript entry") {
+		t.Errorf("got error %v once the transcript ran out", err)
+	}
+}
@@ -0,0 +1,46 @@
+package myq
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// httpClient returns the client used for all of the Session's requests
+// to MyQ: its HTTPClient if set, and otherwise http.DefaultClient
+// unless the Session's Dialer or IPv4Only is set, in which case a
+// client with its own transport is created the first time it is needed.
+func (s *Session) httpClient() *http.Client {
+	if s.HTTPClient != nil {
+		return s.HTTPClient
+	}
+	if s.Dialer == nil && !s.IPv4Only {
+		return http.DefaultClient
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		d := s.Dialer
+		if d == nil {
+			d = &net.Dialer{}
+		}
+
+		dial := d.DialContext
+		if s.IPv4Only {
+			dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if network == "tcp" {
+					network = "tcp4"
+				}
+				return d.DialContext(ctx, network, addr)
+			}
+		}
+
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = dial
+		s.client = &http.Client{Transport: t}
+	}
+
+	return s.client
+}
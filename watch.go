@@ -0,0 +1,65 @@
+package myq
+
+import (
+	"context"
+	"time"
+)
+
+// minWatchInterval is the shortest interval at which Watch polls
+const minWatchInterval = time.Second
+
+// Watch polls the door state of the device with the provided serial
+// number every interval, sending its state on the returned states
+// channel when it is first read and then each time it changes.  Errors
+// polling the device are sent on the errs channel, and polling
+// continues.  Both channels are closed once ctx is done.  Intervals
+// shorter than a second, including zero, are treated as a second, and
+// each is lengthened at random by up to PollJitter.
+func (s *Session) Watch(ctx context.Context, serialNumber string, interval time.Duration) (states <-chan string, errs <-chan error) {
+	statec := make(chan string)
+	errc := make(chan error)
+
+	if interval < minWatchInterval {
+		interval = minWatchInterval
+	}
+
+	go func() {
+		defer close(statec)
+		defer close(errc)
+
+		var last string
+		for {
+			d, err := s.device(ctx, serialNumber)
+
+			switch {
+			case err != nil:
+				if ctx.Err() != nil {
+					return
+				}
+				select {
+				case errc <- err:
+				case <-ctx.Done():
+					return
+				}
+
+			case d.DoorState != last:
+				last = d.DoorState
+				select {
+				case statec <- last:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			t := time.NewTimer(jitter(interval, PollJitter))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	return statec, errc
+}
@@ -0,0 +1,122 @@
+package myq
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitClosed waits for both of Watch's channels to be closed, discarding
+// anything sent on them
+func waitClosed(t *testing.T, states <-chan string, errs <-chan error) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for states != nil || errs != nil {
+		select {
+		case _, ok := <-states:
+			if !ok {
+				states = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		case <-timeout:
+			t.Fatal("channels not closed after cancellation")
+		}
+	}
+}
+
+// checkGoroutines fails if the number of goroutines doesn't return to
+// baseline
+func checkGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	var n int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if n = runtime.NumGoroutine(); n <= baseline {
+			return
+		}
+	}
+
+	buf := make([]byte, 1<<16)
+	t.Fatalf("%d goroutines running, want %d:\n%s", n, baseline, buf[:runtime.Stack(buf, true)])
+}
+
+func TestWatchCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		read bool
+	}{
+		// Cancelled while waiting for the next poll
+		{"after state read", true},
+		// Cancelled while blocked sending the first state
+		{"state unread", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseline := runtime.NumGoroutine()
+
+			f := newFakeMyQ()
+			f.addDevice("1", fakeDoor("CG1", "Garage", StateClosed))
+
+			s, srv := testSession(t, f)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			states, errs := s.Watch(ctx, "CG1", time.Hour)
+
+			if tt.read {
+				select {
+				case state := <-states:
+					if state != StateClosed {
+						t.Errorf("got state %q, want %q", state, StateClosed)
+					}
+				case err := <-errs:
+					t.Fatal(err)
+				case <-time.After(5 * time.Second):
+					t.Fatal("no state received")
+				}
+			} else {
+				// Wait for the state to be read from MyQ
+				for i := 0; i < 500 && f.count("GET", "/api/v5.2/Accounts/1/Devices/CG1") == 0; i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			cancel()
+			waitClosed(t, states, errs)
+
+			srv.Close()
+			checkGoroutines(t, baseline)
+		})
+	}
+}
+
+// Watch must not panic with a zero interval
+func TestWatchZeroInterval(t *testing.T) {
+	f := newFakeMyQ()
+	f.addDevice("1", fakeDoor("CG1", "Garage", StateClosed))
+
+	s, srv := testSession(t, f)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	states, errs := s.Watch(ctx, "CG1", 0)
+
+	select {
+	case <-states:
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state received")
+	}
+
+	cancel()
+	waitClosed(t, states, errs)
+}